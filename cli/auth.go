@@ -0,0 +1,187 @@
+package cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Responses to an authentication query.
+const (
+	authOK     = "ok"
+	authDenied = "denied"
+)
+
+// ReadToken returns the token which clients authenticate with, or an empty
+// string if no token file is set.
+func ReadToken() (token string, err error) {
+	tokenFile := settings.Global().TokenFile
+	if tokenFile == "" {
+		return "", nil
+	}
+	buf, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", errutil.Err(err)
+	}
+	token = strings.TrimSpace(string(buf))
+	if token == "" {
+		return "", errutil.NewNoPosf("cli: empty token file `%s`", tokenFile)
+	}
+	return token, nil
+}
+
+// authenticate checks the authentication query of a client against the token.
+func authenticate(conn net.Conn, query, token string) (err error) {
+	given := strings.TrimPrefix(query, settings.QueryAuth)
+	if !strings.HasPrefix(query, settings.QueryAuth) ||
+		subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		io.WriteString(conn, authDenied+"\n")
+		return errutil.NewNoPosf("cli: client %s failed to authenticate", conn.RemoteAddr())
+	}
+	_, err = io.WriteString(conn, authOK+"\n")
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// checkCleartext returns an error if the token would be sent in cleartext
+// between hosts, i.e. over TCP without TLS on an address other than a loopback
+// address.
+func checkCleartext(addr string) (err error) {
+	global := settings.Global()
+	if global.TokenFile == "" || global.TLS {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return errutil.NewNoPosf("cli: refusing to send the token in cleartext over `%s`; set tls = true or use a loopback address", addr)
+}
+
+// login authenticates with the token to nyfikend.
+func login(conn net.Conn, token string) (err error) {
+	_, err = io.WriteString(conn, settings.QueryAuth+token+"\n")
+	if err != nil {
+		return errutil.Err(err)
+	}
+	// Read the response a byte at a time, so nothing following it is consumed.
+	var resp []byte
+	b := make([]byte, 1)
+	for {
+		_, err = conn.Read(b)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		resp = append(resp, b[0])
+	}
+	if string(resp) != authOK {
+		return errutil.NewNoPos("cli: nyfikend denied the token")
+	}
+	return nil
+}
+
+// loadCert loads the TLS certificate of nyfikend, and generates a self-signed
+// certificate on first run.
+func loadCert() (cert tls.Certificate, err error) {
+	cert, err = tls.LoadX509KeyPair(settings.CertPath, settings.KeyPath)
+	if err == nil {
+		return cert, nil
+	}
+	if _, statErr := os.Stat(settings.CertPath); !os.IsNotExist(statErr) {
+		return cert, errutil.Err(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return cert, errutil.Err(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return cert, errutil.Err(err)
+	}
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "nyfikend " + host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return cert, errutil.Err(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return cert, errutil.Err(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	err = ioutil.WriteFile(settings.KeyPath, keyPEM, settings.DefaultFilePerms)
+	if err != nil {
+		return cert, errutil.Err(err)
+	}
+	err = ioutil.WriteFile(settings.CertPath, certPEM, settings.DefaultFilePerms)
+	if err != nil {
+		return cert, errutil.Err(err)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER encoded certificate,
+// which clients pin.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// clientTLSConfig returns a TLS configuration which only accepts the server
+// certificate with the pinned fingerprint.
+func clientTLSConfig(fingerprint string) (config *tls.Config, err error) {
+	fingerprint = strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+	if fingerprint == "" {
+		return nil, errutil.NewNoPos("cli: the fingerprint of the certificate of nyfikend is required; it's logged by nyfikend on start")
+	}
+	config = &tls.Config{
+		// The certificate is self-signed; it's verified by its fingerprint
+		// instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || Fingerprint(rawCerts[0]) != fingerprint {
+				return errutil.NewNoPos("cli: the certificate of nyfikend doesn't match the pinned fingerprint")
+			}
+			return nil
+		},
+	}
+	return config, nil
+}
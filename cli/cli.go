@@ -2,87 +2,268 @@
 package cli
 
 import (
+	"bufio"
+	"crypto/tls"
 	"encoding/gob"
-	"log"
+	"errors"
+	"io"
+	"log/slog"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/karlek/nyfiken/ini"
+	"github.com/karlek/nyfiken/logging"
 	"github.com/karlek/nyfiken/page"
 	"github.com/karlek/nyfiken/settings"
-	"github.com/mewkiz/pkg/bufioutil"
 	"github.com/mewkiz/pkg/errutil"
 )
 
+// Limits of client connections.
+const (
+	// MaxClients is the maximum number of simultaneously served clients. Further
+	// clients wait until a served client disconnects.
+	MaxClients = 16
+
+	// Timeout is the duration a client may spend on a single query, including
+	// sending the query and receiving the response, before it's disconnected.
+	Timeout = 30 * time.Second
+)
+
 // Listen makes nyfikend wait for a connection from nyfikenc.
 func Listen() {
 	err := errWrapListen()
 	if err != nil {
-		log.Fatalln(errutil.Err(err))
+		logging.Fatal("unable to serve nyfikenc", "err", err)
 	}
 }
 
 func errWrapListen() (err error) {
-	ln, err := net.Listen("tcp", settings.Global.PortNum)
+	ln, err := listen()
 	if err != nil {
 		return errutil.Err(err)
 	}
+	lnMu.Lock()
+	listener = ln
+	lnMu.Unlock()
+	return Serve(ln)
+}
 
-	// Wait for request.
-	for {
-		conn, err := ln.Accept()
+// listener is the listener of Listen, which Close closes.
+var (
+	lnMu     sync.Mutex
+	listener net.Listener
+)
+
+// Close stops nyfikend from accepting connections from nyfikenc. The Unix
+// socket is removed once closed.
+func Close() (err error) {
+	lnMu.Lock()
+	defer lnMu.Unlock()
+	if listener == nil {
+		return nil
+	}
+	err = listener.Close()
+	listener = nil
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// listen listens on the Unix socket, which only the user may access, or on the
+// TCP port if one is set.
+func listen() (ln net.Listener, err error) {
+	global := settings.Global()
+	if global.PortNum != "" {
+		err = checkCleartext(global.PortNum)
 		if err != nil {
-			log.Println(errutil.Err(err))
-			continue
+			return nil, errutil.Err(err)
+		}
+		ln, err = net.Listen("tcp", global.PortNum)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		if global.TLS {
+			cert, err := loadCert()
+			if err != nil {
+				ln.Close()
+				return nil, errutil.Err(err)
+			}
+			slog.Info("TLS certificate of nyfikend", "fingerprint", Fingerprint(cert.Certificate[0]))
+			ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
 		}
+		return ln, nil
+	}
 
-		// Listen for errors from connection.
-		errChan := make(chan error, 1)
-		go errWrapTakeInput(conn, errChan)
-		if err = <-errChan; err != nil {
-			log.Println(errutil.Err(err))
+	// Remove the socket of a previous execution which wasn't shut down, but
+	// nothing else which happens to be at its path.
+	fi, err := os.Lstat(global.Socket)
+	if err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errutil.NewNoPosf("cli: `%s` exists and isn't a socket", global.Socket)
 		}
-		conn.Close()
+		err = os.Remove(global.Socket)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errutil.Err(err)
+	}
+	ln, err = listenUnix(global.Socket)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	err = os.Chmod(global.Socket, settings.SocketPerms)
+	if err != nil {
+		ln.Close()
+		return nil, errutil.Err(err)
 	}
+	return ln, nil
 }
 
-func errWrapTakeInput(conn net.Conn, outerErrChan chan error) {
-	outerErrChan <- takeInput(conn)
+// Dial connects to nyfikend on the Unix socket, or on the TCP port if one is
+// set, and authenticates if a token file is set.
+func Dial() (conn net.Conn, err error) {
+	token, err := ReadToken()
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+
+	global := settings.Global()
+	network, addr := "unix", global.Socket
+	if global.PortNum != "" {
+		network, addr = "tcp", global.PortNum
+		// A port number without a host, e.g. ":5239", refers to the local host.
+		if strings.HasPrefix(addr, ":") {
+			addr = "localhost" + addr
+		}
+		err = checkCleartext(addr)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+	}
+	dialer := &net.Dialer{Timeout: settings.TimeoutDuration}
+	if network == "tcp" && global.TLS {
+		var config *tls.Config
+		config, err = clientTLSConfig(global.Fingerprint)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		var tlsConn *tls.Conn
+		tlsConn, err = tls.DialWithDialer(dialer, network, addr, config)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		conn = tlsConn
+	} else {
+		conn, err = dialer.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+
+	if token != "" {
+		conn.SetDeadline(time.Now().Add(settings.TimeoutDuration))
+		err = login(conn, token)
+		if err != nil {
+			conn.Close()
+			return nil, errutil.Err(err)
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, nil
+}
+
+// Serve serves the clients which connect to ln concurrently, until ln is
+// closed.
+func Serve(ln net.Listener) (err error) {
+	sem := make(chan struct{}, MaxClients)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				slog.Warn("unable to accept nyfikenc connection", "err", err)
+				continue
+			}
+			return errutil.Err(err)
+		}
+
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			defer conn.Close()
+			err := takeInput(conn)
+			if err != nil {
+				slog.Error("nyfikenc query failed", "client", conn.RemoteAddr().String(), "err", err)
+			}
+		}()
+	}
 }
 
 // Wait for input and send output to client.
 func takeInput(conn net.Conn) (err error) {
+	// Clients must authenticate with the token first, if one is set.
+	token, err := ReadToken()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	authenticated := token == ""
+
+	s := bufio.NewScanner(conn)
 	for {
-		// NOTE: A new reader is created on each iteration of the loop. While
-		// functionally correct it is wasteful. Consider placing the
-		// bufioutil.NewReader outside of the loop, or even better consider using
-		// bufio.NewScanner to read lines.
-		query, err := bufioutil.NewReader(conn).ReadLine()
+		// Disconnect clients which hang, so they don't occupy the connection.
+		err = conn.SetDeadline(time.Now().Add(Timeout))
 		if err != nil {
-			// NOTE: Seems like a hack. Why not check against io.EOF?
-			if err.Error() == "EOF" {
-				break
-			}
 			return errutil.Err(err)
 		}
+		if !s.Scan() {
+			break
+		}
+		query := s.Text()
+		if !authenticated {
+			err = authenticate(conn, query, token)
+			if err != nil {
+				return errutil.Err(err)
+			}
+			authenticated = true
+			continue
+		}
+		if strings.HasPrefix(query, settings.QueryAuth) {
+			// No token is set, so every client is authenticated.
+			_, err = io.WriteString(conn, authOK+"\n")
+			if err != nil {
+				return errutil.Err(err)
+			}
+			continue
+		}
 
 		// Do something with the query
 		switch query {
 		case settings.QueryUpdates:
 			// Encode (send) the value.
-			err = gob.NewEncoder(conn).Encode(settings.Updates)
+			err = gob.NewEncoder(conn).Encode(settings.Updates())
 		case settings.QueryClearAll:
-			settings.Updates = make(map[string]bool)
-			err = settings.SaveUpdates()
-		case settings.QueryForceRecheck:
-			pages, err := ini.ReadPages(settings.PagesPath)
+			// The snapshots are copied by nyfikend, since nyfikenc may run on
+			// another host.
+			err = page.MarkAllRead()
 			if err != nil {
 				return errutil.Err(err)
 			}
-			err = page.ForceUpdate(pages)
+			err = settings.SaveUpdates()
+		case settings.QueryForceRecheck:
+			err = page.ForceUpdate(page.Pages())
 		}
 		if err != nil {
 			return errutil.Err(err)
 		}
 	}
+	// The client has disconnected.
+	err = s.Err()
+	if err != nil {
+		return errutil.Err(err)
+	}
 	return nil
 }
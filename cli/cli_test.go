@@ -0,0 +1,430 @@
+package cli
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karlek/nyfiken/settings"
+)
+
+// serve starts serving clients on the loopback interface and returns the
+// listener.
+func serve(t *testing.T) (ln net.Listener) {
+	dir, err := ioutil.TempDir("", "nyfiken-cli")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	settings.UpdatesPath = filepath.Join(dir, "updates.gob")
+	settings.CacheRoot = dir + "/cache/"
+	settings.ReadRoot = dir + "/read/"
+	settings.DebugCacheRoot = dir + "/debug/cache/"
+	settings.DebugReadRoot = dir + "/debug/read/"
+
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	go Serve(ln)
+	return ln
+}
+
+// query sends a query and returns the updates if requested.
+func query(addr, q string) (ups map[string]bool, err error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	bw := bufio.NewWriter(conn)
+	fmt.Fprintln(bw, q)
+	err = bw.Flush()
+	if err != nil {
+		return nil, err
+	}
+	if q != settings.QueryUpdates {
+		return nil, nil
+	}
+	err = gob.NewDecoder(conn).Decode(&ups)
+	return ups, err
+}
+
+func TestServeParallel(t *testing.T) {
+	ln := serve(t)
+	defer ln.Close()
+	defer os.RemoveAll(filepath.Dir(settings.UpdatesPath))
+	addr := ln.Addr().String()
+
+	// A client which connects but never sends a query mustn't lock out other
+	// clients.
+	hung, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("net.Dial:", err)
+	}
+	defer hung.Close()
+
+	const n = 64
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		// Page checks which update concurrently with the clients.
+		go func(i int) {
+			defer wg.Done()
+			settings.AddUpdate(fmt.Sprintf("http://example.org/%d", i))
+			if err := settings.SaveUpdates(); err != nil {
+				errs <- err
+			}
+		}(i)
+		// Clients which query and clear the updates.
+		go func(i int) {
+			defer wg.Done()
+			q := settings.QueryUpdates
+			if i%8 == 0 {
+				q = settings.QueryClearAll
+			}
+			if _, err := query(addr, q); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// The server still responds after all clients have been served.
+	settings.ClearUpdates()
+	settings.AddUpdate("http://example.org/last")
+	ups, err := query(addr, settings.QueryUpdates)
+	if err != nil {
+		t.Fatal("query:", err)
+	}
+	if len(ups) != 1 || !ups["http://example.org/last"] {
+		t.Errorf("expected the last update, got %v", ups)
+	}
+}
+
+func TestClearAll(t *testing.T) {
+	ln := serve(t)
+	defer ln.Close()
+	defer os.RemoveAll(filepath.Dir(settings.UpdatesPath))
+	addr := ln.Addr().String()
+
+	// nyfikend copies the snapshots, since nyfikenc may run on another host.
+	for _, root := range []string{settings.CacheRoot, settings.ReadRoot, settings.DebugCacheRoot, settings.DebugReadRoot} {
+		os.MkdirAll(root, 0755)
+	}
+	err := ioutil.WriteFile(settings.CacheRoot+"example.org.htm", []byte("new"), 0600)
+	if err != nil {
+		t.Fatal("ioutil.WriteFile:", err)
+	}
+	settings.ClearUpdates()
+	settings.AddUpdate("http://example.org")
+
+	// The updates are queried on the same connection, once they are cleared.
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal("net.DialTimeout:", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintln(conn, settings.QueryClearAll)
+	fmt.Fprintln(conn, settings.QueryUpdates)
+	var ups map[string]bool
+	err = gob.NewDecoder(conn).Decode(&ups)
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if len(ups) != 0 {
+		t.Errorf("expected no updates, got %v", ups)
+	}
+	buf, err := ioutil.ReadFile(settings.ReadRoot + "example.org.htm")
+	if err != nil {
+		t.Fatal("ioutil.ReadFile:", err)
+	}
+	if string(buf) != "new" {
+		t.Errorf("read snapshot %q != expected %q", buf, "new")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-cli")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.UpdatesPath = filepath.Join(dir, "updates.gob")
+	defer settings.SetGlobal(settings.Global())
+	g := *settings.Global()
+	g.PortNum = ""
+	g.Socket = filepath.Join(dir, "nyfiken.sock")
+	settings.SetGlobal(&g)
+
+	// Other files are kept.
+	err = ioutil.WriteFile(g.Socket, nil, 0644)
+	if err != nil {
+		t.Fatal("ioutil.WriteFile:", err)
+	}
+	if ln, err := listen(); err == nil {
+		ln.Close()
+		t.Fatal("expected a file which isn't a socket to be kept")
+	}
+	os.Remove(g.Socket)
+
+	// A stale socket of a previous execution is replaced.
+	stale, err := net.Listen("unix", g.Socket)
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen()
+	if err != nil {
+		t.Fatal("listen:", err)
+	}
+	defer ln.Close()
+	go Serve(ln)
+
+	fi, err := os.Stat(g.Socket)
+	if err != nil {
+		t.Fatal("os.Stat:", err)
+	}
+	if perm := fi.Mode().Perm(); perm != settings.SocketPerms {
+		t.Errorf("socket permissions %v != expected %v", perm, settings.SocketPerms)
+	}
+
+	settings.ClearUpdates()
+	settings.AddUpdate("http://example.org")
+	conn, err := Dial()
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, settings.QueryUpdates)
+	var ups map[string]bool
+	err = gob.NewDecoder(conn).Decode(&ups)
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if !ups["http://example.org"] {
+		t.Errorf("expected update of http://example.org, got %v", ups)
+	}
+}
+
+func TestCheckCleartext(t *testing.T) {
+	defer settings.SetGlobal(settings.Global())
+
+	golden := []struct {
+		tokenFile string
+		tls       bool
+		addr      string
+		wantErr   bool
+	}{
+		// i=0
+		{tokenFile: "token", addr: "localhost:5239"},
+		// i=1
+		{tokenFile: "token", addr: "127.0.0.1:5239"},
+		// i=2
+		{tokenFile: "token", addr: "[::1]:5239"},
+		// i=3
+		{tokenFile: "token", addr: ":5239", wantErr: true},
+		// i=4
+		{tokenFile: "token", addr: "192.0.2.1:5239", wantErr: true},
+		// i=5
+		{tokenFile: "token", addr: "example.com:5239", wantErr: true},
+		// i=6
+		{tokenFile: "token", tls: true, addr: ":5239"},
+		// i=7
+		{addr: ":5239"},
+	}
+
+	for i, g := range golden {
+		global := *settings.Global()
+		global.TokenFile, global.TLS = g.tokenFile, g.tls
+		settings.SetGlobal(&global)
+		err := checkCleartext(g.addr)
+		if g.wantErr && err == nil {
+			t.Errorf("i=%d: expected error, got nil", i)
+		} else if !g.wantErr && err != nil {
+			t.Errorf("i=%d: %v", i, err)
+		}
+	}
+}
+
+func TestAuthTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-cli")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.UpdatesPath = filepath.Join(dir, "updates.gob")
+	settings.CertPath = filepath.Join(dir, "cert.pem")
+	settings.KeyPath = filepath.Join(dir, "key.pem")
+	defer settings.SetGlobal(settings.Global())
+	global := *settings.Global()
+	global.TokenFile = filepath.Join(dir, "token")
+	err = ioutil.WriteFile(global.TokenFile, []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal("ioutil.WriteFile:", err)
+	}
+	global.TLS = true
+
+	// Listen on a free port.
+	global.PortNum = "127.0.0.1:0"
+	settings.SetGlobal(&global)
+	ln, err := listen()
+	if err != nil {
+		t.Fatal("listen:", err)
+	}
+	defer ln.Close()
+	go Serve(ln)
+	addr := ln.Addr().String()
+
+	cert, err := loadCert()
+	if err != nil {
+		t.Fatal("loadCert:", err)
+	}
+	fingerprint := Fingerprint(cert.Certificate[0])
+
+	golden := []struct {
+		token       string
+		fingerprint string
+		wantErr     bool
+	}{
+		// i=0
+		{token: "secret", fingerprint: fingerprint},
+		// i=1
+		{token: "secret", fingerprint: strings.ToUpper(fingerprint)},
+		// i=2
+		{token: "wrong", fingerprint: fingerprint, wantErr: true},
+		// i=3
+		{token: "secret", fingerprint: Fingerprint([]byte("other")), wantErr: true},
+		// i=4
+		{token: "secret", wantErr: true},
+	}
+
+	for i, g := range golden {
+		err := func() error {
+			config, err := clientTLSConfig(g.fingerprint)
+			if err != nil {
+				return err
+			}
+			conn, err := tls.Dial("tcp", addr, config)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			return login(conn, g.token)
+		}()
+		if g.wantErr {
+			if err == nil {
+				t.Errorf("i=%d: expected error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("i=%d: %v", i, err)
+		}
+	}
+
+	// Dial authenticates with the token file and queries over TLS.
+	dialed := global
+	dialed.PortNum = addr
+	dialed.Fingerprint = fingerprint
+	settings.SetGlobal(&dialed)
+	settings.ClearUpdates()
+	settings.AddUpdate("http://example.org")
+	conn, err := Dial()
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, settings.QueryUpdates)
+	var ups map[string]bool
+	err = gob.NewDecoder(conn).Decode(&ups)
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if !ups["http://example.org"] {
+		t.Errorf("expected update of http://example.org, got %v", ups)
+	}
+
+	// Clients which don't authenticate are denied.
+	config, err := clientTLSConfig(fingerprint)
+	if err != nil {
+		t.Fatal("clientTLSConfig:", err)
+	}
+	conn, err = tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatal("tls.Dial:", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintln(conn, settings.QueryUpdates)
+	resp, _ := ioutil.ReadAll(conn)
+	if string(resp) != authDenied+"\n" {
+		t.Errorf("expected %q, got %q", authDenied+"\n", resp)
+	}
+}
+
+func TestClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-cli")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	defer settings.SetGlobal(settings.Global())
+	g := *settings.Global()
+	g.PortNum = ""
+	g.Socket = filepath.Join(dir, "nyfiken.sock")
+	settings.SetGlobal(&g)
+
+	done := make(chan error)
+	go func() {
+		done <- errWrapListen()
+	}()
+	// Wait for nyfikend to listen.
+	for i := 0; ; i++ {
+		lnMu.Lock()
+		ln := listener
+		lnMu.Unlock()
+		if ln != nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("nyfikend didn't listen")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = Close()
+	if err != nil {
+		t.Fatal("Close:", err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("expected Serve to return nil once closed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return once closed")
+	}
+	if _, err := os.Stat(g.Socket); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package cli
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix listens on the Unix socket at path, which no other user may
+// connect to.
+func listenUnix(path string) (ln net.Listener, err error) {
+	// The umask is set while the socket is created, since other users could
+	// otherwise connect before its permissions are changed. It only removes
+	// the permissions of other users, so files created meanwhile by other
+	// goroutines stay usable.
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
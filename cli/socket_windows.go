@@ -0,0 +1,10 @@
+package cli
+
+import (
+	"net"
+)
+
+// listenUnix listens on the Unix socket at path.
+func listenUnix(path string) (ln net.Listener, err error) {
+	return net.Listen("unix", path)
+}
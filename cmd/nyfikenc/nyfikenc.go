@@ -3,16 +3,16 @@ package main
 
 import (
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"net/url"
 	"os"
 	"os/exec"
+	"syscall"
 
-	"github.com/karlek/nyfiken/filename"
+	"github.com/karlek/nyfiken/cli"
 	"github.com/karlek/nyfiken/ini"
 	"github.com/karlek/nyfiken/settings"
 	"github.com/mewkiz/pkg/bufioutil"
@@ -65,16 +65,23 @@ func nyfikenc() (err error) {
 	// with the -http flag. E.g. both `godoc -http=:3000` and `godoc
 	// -http=localhost:3000` works.
 
+	// Read the address of nyfikend from the config file, if there is one.
+	if _, err := os.Stat(settings.ConfigPath); err == nil {
+		err = ini.ReadClientSettings(settings.ConfigPath)
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+
 	// Connect to nyfikend.
-	conn, err := net.Dial("tcp", "localhost"+settings.Global.PortNum)
+	conn, err := cli.Dial()
 	if err != nil {
-		if e, ok := err.(*net.OpError); ok {
-			if e.Err.Error() == "connection refused" {
-				return errutil.NewNoPos("nyfikenc: unable to connect to nyfikend. Please make sure that the daemon is running.")
-			}
-		} else {
-			return err
+		// Only hint about the daemon if it isn't running; a rejected token or a
+		// mismatching fingerprint is reported as is.
+		if notRunning(err) {
+			return errutil.NewNoPosf("nyfikenc: unable to connect to nyfikend: %v. Please make sure that the daemon is running.", cause(err))
 		}
+		return errutil.Err(err)
 	}
 	bw := bufioutil.NewWriter(conn)
 
@@ -91,7 +98,7 @@ func nyfikenc() (err error) {
 			return force(&bw)
 		}
 		if flagClearAll {
-			return clearAll(&bw, conn)
+			return clearAll(&bw)
 		}
 		if flagReadAll {
 			return readAll(&bw, conn)
@@ -101,7 +108,7 @@ func nyfikenc() (err error) {
 			if err != nil {
 				return err
 			}
-			return clearAll(&bw, conn)
+			return clearAll(&bw)
 		}
 	}
 
@@ -125,20 +132,32 @@ func nyfikenc() (err error) {
 	return nil
 }
 
-// Opens all links with browser.
-func readAll(bw *bufioutil.Writer, conn net.Conn) (err error) {
-	// Read in config file to settings.Global
-	err = ini.ReadSettings(settings.ConfigPath)
-	if err != nil {
-		return errutil.Err(err)
+// cause returns the error wrapped by errutil, without position information.
+func cause(err error) error {
+	if e, ok := err.(*errutil.ErrInfo); ok {
+		return e.Err
 	}
+	return err
+}
 
+// notRunning reports whether dialing nyfikend failed because it isn't running,
+// i.e. its socket doesn't exist or the connection was refused.
+func notRunning(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(cause(err), &opErr) || opErr.Op != "dial" {
+		return false
+	}
+	return errors.Is(opErr, syscall.ENOENT) || errors.Is(opErr, syscall.ECONNREFUSED)
+}
+
+// Opens all links with browser.
+func readAll(bw *bufioutil.Writer, conn net.Conn) (err error) {
 	ups, err := getUpdates(bw, conn)
 	if err != nil {
 		return errutil.Err(err)
 	}
 
-	if settings.Global.Browser == "" {
+	if settings.Global().Browser == "" {
 		fmt.Println("No browser path set in:", settings.ConfigPath)
 		return nil
 	}
@@ -154,7 +173,7 @@ func readAll(bw *bufioutil.Writer, conn net.Conn) (err error) {
 	for up := range ups {
 		arguments = append(arguments, up)
 	}
-	cmd := exec.Command(settings.Global.Browser, arguments...)
+	cmd := exec.Command(settings.Global().Browser, arguments...)
 	err = cmd.Start()
 	if err != nil {
 		return errutil.Err(err)
@@ -162,64 +181,8 @@ func readAll(bw *bufioutil.Writer, conn net.Conn) (err error) {
 	return nil
 }
 
-// Removes all updates.
-func clearAll(bw *bufioutil.Writer, conn net.Conn) (err error) {
-	ups, err := getUpdates(bw, conn)
-	if err != nil {
-		return errutil.Err(err)
-	}
-
-	for up := range ups {
-		u, err := url.Parse(up)
-		if err != nil {
-			return errutil.Err(err)
-		}
-
-		// NOTE: The UrlAsFilename method on *page.Page should be factored into a
-		// function which accepts an *url.URL. That was the behaviour can be
-		// implemented once and will stay consistent between implementation if it
-		// is updated in the future.
-		urlAsFilename := u.Host + u.Path + u.RawQuery
-		fname, err := filename.Encode(urlAsFilename)
-		if err != nil {
-			return errutil.Err(err)
-		}
-
-		// NOTE: Consider using filepath.Join.
-		cacheFile, err := os.Open(settings.CacheRoot + fname + ".htm")
-		if err != nil {
-			return errutil.Err(err)
-		}
-		defer cacheFile.Close()
-		readFile, err := os.Create(settings.ReadRoot + fname + ".htm")
-		if err != nil {
-			return errutil.Err(err)
-		}
-		defer readFile.Close()
-
-		_, err = io.Copy(readFile, cacheFile)
-		if err != nil {
-			return errutil.Err(err)
-		}
-
-		// Debug
-		debugCacheFile, err := os.Open(settings.DebugCacheRoot + fname + ".htm")
-		if err != nil {
-			return errutil.Err(err)
-		}
-		defer cacheFile.Close()
-		debugReadFile, err := os.Create(settings.DebugReadRoot + fname + ".htm")
-		if err != nil {
-			return errutil.Err(err)
-		}
-		defer readFile.Close()
-
-		_, err = io.Copy(debugReadFile, debugCacheFile)
-		if err != nil {
-			return errutil.Err(err)
-		}
-	}
-
+// Removes all updates. nyfikend marks them as read, i.e. copies their snapshots.
+func clearAll(bw *bufioutil.Writer) (err error) {
 	// Send nyfikend a query to clear updates.
 	_, err = bw.WriteLine(settings.QueryClearAll)
 	if err != nil {
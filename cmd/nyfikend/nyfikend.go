@@ -3,29 +3,45 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/howeyc/fsnotify"
 	"github.com/karlek/nyfiken/cli"
+	"github.com/karlek/nyfiken/digest"
+	"github.com/karlek/nyfiken/feed"
 	"github.com/karlek/nyfiken/filename"
+	"github.com/karlek/nyfiken/history"
 	"github.com/karlek/nyfiken/ini"
+	"github.com/karlek/nyfiken/instance"
+	"github.com/karlek/nyfiken/logging"
 	"github.com/karlek/nyfiken/page"
 	"github.com/karlek/nyfiken/settings"
+	"github.com/karlek/nyfiken/web"
 	"github.com/mewkiz/pkg/errutil"
 )
 
-var flagClean bool
+var (
+	flagClean   bool
+	flagStop    bool
+	flagVerbose bool
+)
 
 func init() {
-	flag.BoolVar(&settings.Verbose, "v", false, "Verbose.")
+	flag.BoolVar(&flagVerbose, "v", false, "Verbose; log debug records.")
 	flag.BoolVar(&flagClean, "c", false, "Remove old cache files.")
+	flag.BoolVar(&flagStop, "stop", false, "Stop the running nyfikend.")
 	flag.Usage = usage
 }
 
@@ -41,20 +57,61 @@ func main() {
 	flag.Parse()
 	err := nyfikend()
 	if err != nil {
-		log.Fatalln(errutil.Err(err))
+		logging.Fatal("nyfikend failed", "err", errutil.Err(err))
 	}
 }
 
-var pages []*page.Page
+// setupLogging configures logging from the global settings, where the verbose
+// flag overrides the log level.
+func setupLogging(global *settings.Prog) (err error) {
+	level := global.LogLevel
+	if flagVerbose {
+		level = "debug"
+	}
+	return logging.Setup(logging.Config{
+		Level:   level,
+		Format:  global.LogFormat,
+		File:    global.LogFile,
+		MaxSize: global.LogMaxSize,
+		Backups: global.LogBackups,
+	})
+}
 
 func nyfikend() (err error) {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	if flagStop {
+		pid, err := instance.Stop()
+		if err != nil {
+			return errutil.Err(err)
+		}
+		fmt.Printf("Stopped nyfikend (pid %d).\n", pid)
+		return nil
+	}
+
+	// Refuse to race another nyfikend on the cache files and updates.
+	err = instance.Lock()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	defer instance.Unlock()
+
 	if flagClean {
 		return clean()
 	}
 
-	pages, err = ini.ReadIni(settings.ConfigPath, settings.PagesPath)
+	// Refuse to leak secrets to other users.
+	err = ini.CheckSecrets(settings.ConfigPath, settings.PagesPath)
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	pages, err := ini.ReadIni(settings.ConfigPath, settings.PagesPath)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	page.SetPages(pages)
+	err = setupLogging(settings.Global())
 	if err != nil {
 		return errutil.Err(err)
 	}
@@ -62,99 +119,234 @@ func nyfikend() (err error) {
 	// NOTE: I love the fact that you are monitoring file system events to check
 	// when the config is updated! This makes nyfikend a friendly daemon :)
 
-	// Change settings files only when config files are modified.
+	// Change settings files only when config files are modified. The
+	// directories of the files are watched, since editors which save by
+	// renaming a new file over the old one replace the watched file.
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return errutil.Err(err)
 	}
-	go errWrapWatchConfig(watcher)
-	err = watcher.Watch(settings.ConfigPath)
+	go watchConfig(watcher)
+	dirs := map[string]bool{
+		filepath.Dir(settings.ConfigPath): true,
+		filepath.Dir(settings.PagesPath):  true,
+	}
+	for dir := range dirs {
+		err = watcher.Watch(dir)
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+
+	// Listen for nyfikenc queries.
+	go cli.Listen()
+
+	// Serve Atom feeds of updates.
+	err = feed.Load()
 	if err != nil {
 		return errutil.Err(err)
 	}
-	err = watcher.Watch(settings.PagesPath)
+	if settings.Global().FeedAddr != "" {
+		go feed.Listen()
+	}
+
+	// Serve the HTTP API.
+	if settings.Global().HTTPAddr != "" {
+		go web.Listen()
+	}
+
+	// Load recent snapshots and notifications used to suppress notifications.
+	err = history.Load()
 	if err != nil {
 		return errutil.Err(err)
 	}
 
-	// Listen for nyfikenc queries.
-	go cli.Listen()
+	// Send digest mails when they are due.
+	err = digest.Load()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	go digest.Run()
+
+	// Summarize suppressed notifications once their window has passed.
+	go page.RunSummaries()
 
+	// Reload the config files on SIGHUP, and stop on SIGINT or SIGTERM.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloadOnHangup(hup)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
 	var secondsElapsed float64
 	for ; ; secondsElapsed++ {
-		// A channel in which errors are sent from p.Check().
-		errChan := make(chan error)
-
-		// The number of checks currently taking place.
-		var numChecks int
-		for _, p := range pages {
+		var due []*page.Page
+		// The pages may be swapped by a reload of the config files.
+		for _, p := range page.Pages() {
 			// If the seconds elapsed modulo the duration of the interval in
 			// seconds is equal to zero, the page should be checked.
 			if math.Mod(float64(secondsElapsed), p.Settings.Interval.Seconds()) != 0 {
 				continue
 			}
-			// Start a go-routine to check if the page has been updated.
-			go p.Check(errChan)
-			numChecks++
+			due = append(due, p)
+		}
+		// Check the pages in the background.
+		err = page.ForceUpdate(due)
+		if err != nil {
+			return errutil.Err(err)
 		}
 
-		// For each check that took place, listen if any check returned an
-		// error.
-		go func(ch chan error, nChecks int) {
-			for i := 0; i < nChecks; i++ {
-				if err := <-ch; err != nil {
-					log.Println(errutil.Err(err))
-				}
-			}
-		}(errChan, numChecks)
+		select {
+		case <-ticker.C:
+		case sig := <-stop:
+			slog.Info("stopping", "signal", sig.String())
+			signal.Stop(stop)
+			return shutdown()
+		}
+	}
+}
 
-		time.Sleep(1 * time.Second)
+// shutdown stops starting new checks, waits for in-flight checks, saves the
+// updates, sends due digests and stops serving clients.
+func shutdown() (err error) {
+	if !page.Stop(settings.ShutdownTimeout) {
+		slog.Warn("checks still running after shutdown timeout", "timeout", settings.ShutdownTimeout.String())
+	}
+	err = settings.SaveUpdates()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	// Send the digests which became due since the last flush; the others are
+	// already saved and sent by the next execution.
+	err = digest.Flush(time.Now())
+	if err != nil {
+		slog.Error("unable to send digests", "err", err)
 	}
 
+	err = cli.Close()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), settings.TimeoutDuration)
+	defer cancel()
+	err = feed.Shutdown(ctx)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	err = web.Shutdown(ctx)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	slog.Info("stopped")
 	return nil
 }
 
-// Reads config files only when they are modified.
-func errWrapWatchConfig(watcher *fsnotify.Watcher) {
-	err := watchConfig(watcher)
-	if err != nil {
-		log.Fatalln(errutil.Err(err))
+// reloadOnHangup reloads the config files on every SIGHUP.
+func reloadOnHangup(hup <-chan os.Signal) {
+	for range hup {
+		slog.Info("reloading config files")
+		reloadOrKeep(true)
 	}
 }
 
-func watchConfig(watcher *fsnotify.Watcher) (err error) {
+// watchConfig reloads the config files once they have been left unmodified
+// for settings.ReloadDelay, so a burst of writes causes a single reload. Errors
+// are logged, and the old config is kept.
+func watchConfig(watcher *fsnotify.Watcher) {
+	// due is nil while no reload is pending.
+	var due <-chan time.Time
+	var configChanged bool
 	for {
 		select {
-		case ev := <-watcher.Event:
-			if ev != nil {
-				if ev.Name == settings.ConfigPath {
-					// Read settings from config file.
-					err = ini.ReadSettings(settings.ConfigPath)
-					if err != nil {
-						return errutil.Err(err)
-					}
-				}
-				// NOTE: The global pages variable will not be updated by the
-				// watcher. Is this a bug? If so, use use `=` instead of `:=`.
-
-				// Retrieve an array of pages from INI file.
-				pages, err := ini.ReadPages(settings.PagesPath)
-				if err != nil {
-					return errutil.Err(err)
-				}
-				err = page.ForceUpdate(pages)
-				if err != nil {
-					return errutil.Err(err)
-				}
+		case ev, ok := <-watcher.Event:
+			if !ok {
+				return
+			}
+			if ev == nil {
+				continue
+			}
+			// Ignore the other files of the watched directories.
+			name := filepath.Clean(ev.Name)
+			isConfig := name == filepath.Clean(settings.ConfigPath)
+			if !isConfig && name != filepath.Clean(settings.PagesPath) {
+				continue
+			}
+			slog.Debug("config file changed", "file", ev.Name)
+			if isConfig {
+				configChanged = true
+			}
+			due = time.After(settings.ReloadDelay)
+		case <-due:
+			slog.Info("reloading config files")
+			reloadOrKeep(configChanged)
+			due, configChanged = nil, false
+		case err, ok := <-watcher.Error:
+			if !ok {
+				return
 			}
-		case err = <-watcher.Error:
 			if err != nil {
-				return errutil.Err(err)
+				slog.Error("unable to watch config files", "err", errutil.Err(err))
 			}
 		}
 	}
 }
 
+// reloadOrKeep reloads the config files, and logs the error and keeps the old
+// config if they are invalid.
+func reloadOrKeep(configChanged bool) {
+	err := reload(configChanged)
+	if err != nil {
+		slog.Error("unable to reload config files; keeping the old config", "err", errutil.Err(err))
+	}
+}
+
+// reloadMu serializes reloads from SIGHUP and from modified config files.
+var reloadMu sync.Mutex
+
+// reload reads the pages file, and the config file if it has changed, swaps
+// the settings and the checked pages and checks them immediately. Neither is
+// changed if either file is invalid.
+func reload(configChanged bool) (err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	// Refuse to leak secrets which have been added to the config files.
+	err = ini.CheckSecrets(settings.ConfigPath, settings.PagesPath)
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	global := settings.Global()
+	if configChanged {
+		// Read settings from config file.
+		global, err = ini.ParseSettings(settings.ConfigPath)
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+
+	// Retrieve an array of pages from INI file.
+	pages, err := ini.ParsePages(settings.PagesPath, global)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if configChanged {
+		err = setupLogging(global)
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+	settings.SetGlobal(global)
+	page.SetPages(pages)
+	err = page.ForceUpdate(pages)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
 // clean removes old cache files from cache root.
 func clean() (err error) {
 	// Get a list of all pages.
@@ -0,0 +1,82 @@
+// Package diff describes the differences between two texts line by line.
+package diff
+
+import (
+	"strings"
+)
+
+// maxCells is the largest LCS table which is computed. Larger differences fall
+// back to listing all differing lines as removed and added.
+const maxCells = 4 << 20
+
+// Lines returns the lines which differ between a and b. Removed lines are
+// prefixed with "-" and added lines with "+".
+func Lines(a, b string) string {
+	as := strings.Split(a, "\n")
+	bs := strings.Split(b, "\n")
+
+	// Skip common prefix and suffix, which is usually most of a page.
+	var pre int
+	for pre < len(as) && pre < len(bs) && as[pre] == bs[pre] {
+		pre++
+	}
+	as, bs = as[pre:], bs[pre:]
+	var suf int
+	for suf < len(as) && suf < len(bs) && as[len(as)-1-suf] == bs[len(bs)-1-suf] {
+		suf++
+	}
+	as, bs = as[:len(as)-suf], bs[:len(bs)-suf]
+
+	var out []string
+	if len(as)*len(bs) > maxCells {
+		for _, line := range as {
+			out = append(out, "-"+line)
+		}
+		for _, line := range bs {
+			out = append(out, "+"+line)
+		}
+		return join(out)
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of as[i:] and
+	// bs[j:].
+	lcs := make([][]int, len(as)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(as) || j < len(bs) {
+		switch {
+		case i < len(as) && j < len(bs) && as[i] == bs[j]:
+			i++
+			j++
+		case j == len(bs) || (i < len(as) && lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "-"+as[i])
+			i++
+		default:
+			out = append(out, "+"+bs[j])
+			j++
+		}
+	}
+	return join(out)
+}
+
+// join joins lines with a trailing newline.
+func join(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
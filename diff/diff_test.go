@@ -0,0 +1,25 @@
+package diff
+
+import (
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	var golden = []struct {
+		a, b string
+		want string
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", ""},
+		{"a\nb\nc\n", "a\nx\nc\n", "-b\n+x\n"},
+		{"a\nb\n", "a\nb\nc\n", "+c\n"},
+		{"a\nb\nc\nd\n", "a\nd\n", "-b\n-c\n"},
+		{"a\nb\nc\n", "b\nc\nd\n", "-a\n+d\n"},
+	}
+
+	for _, g := range golden {
+		got := Lines(g.a, g.b)
+		if got != g.want {
+			t.Errorf("output %q != expected %q", got, g.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Package digest collects updates per recipient and mails them together once
+// the schedule of the recipient is due.
+package digest
+
+import (
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karlek/nyfiken/mail"
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Kinds of schedules.
+const (
+	Immediate = "immediate" // Send one mail per update.
+	Hourly    = "hourly"    // Send a digest at the start of every hour.
+	Daily     = "daily"     // Send a digest every day at a fixed time.
+)
+
+// Schedule specifies when the digest of a recipient is sent.
+type Schedule struct {
+	Kind string        // Kind of schedule.
+	At   time.Duration // Time of day of daily digests, as an offset from midnight.
+}
+
+// ParseSchedule parses a schedule; "immediate", "hourly", "daily" or
+// "daily@HH:MM".
+func ParseSchedule(s string) (sched Schedule, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "", Immediate:
+		return Schedule{Kind: Immediate}, nil
+	case Hourly:
+		return Schedule{Kind: Hourly}, nil
+	case Daily:
+		return Schedule{Kind: Daily}, nil
+	}
+	if strings.HasPrefix(s, Daily+"@") {
+		t, err := time.Parse("15:04", strings.TrimPrefix(s, Daily+"@"))
+		if err != nil {
+			return Schedule{}, errutil.NewNoPosf("digest: invalid time of day in schedule `%s`", s)
+		}
+		at := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		return Schedule{Kind: Daily, At: at}, nil
+	}
+	return Schedule{}, errutil.NewNoPosf("digest: invalid schedule `%s`; correct syntax -> `immediate`, `hourly` or `daily@HH:MM`", s)
+}
+
+// Next returns the time when a digest started at since is due.
+func (sched Schedule) Next(since time.Time) time.Time {
+	y, m, d := since.Date()
+	switch sched.Kind {
+	case Hourly:
+		return time.Date(y, m, d, since.Hour(), 0, 0, 0, since.Location()).Add(time.Hour)
+	case Daily:
+		next := time.Date(y, m, d, 0, 0, 0, 0, since.Location()).Add(sched.At)
+		if !next.After(since) {
+			next = time.Date(y, m, d+1, 0, 0, 0, 0, since.Location()).Add(sched.At)
+		}
+		return next
+	}
+	return since
+}
+
+// ScheduleOf returns the schedule of a recipient, which defaults to the global
+// digest schedule.
+func ScheduleOf(recipient string) (sched Schedule, err error) {
+	global := settings.Global()
+	s, ok := global.Digest.Recipients[recipient]
+	if !ok {
+		s = global.Digest.Default
+	}
+	return ParseSchedule(s)
+}
+
+// Entry is an update of a page which is pending in a digest.
+type Entry struct {
+	URL     string            // URL of the updated page.
+	Name    string            // Name of the page.
+	Time    time.Time         // Time of detection.
+	Diff    string            // Differing lines between the last and current check.
+	Content string            // HTML selection of the page.
+	Fields  map[string]string // Values of the named fields of the page.
+
+	Suppressed int // Number of suppressed notifications before the update.
+}
+
+// queue is the pending digest of a recipient.
+type queue struct {
+	Since   time.Time // Time of the first pending update.
+	Entries []Entry
+}
+
+// pending are the pending digests by recipient mail address.
+var (
+	mu      sync.Mutex
+	pending = make(map[string]*queue)
+)
+
+// send sends a digest; replaced in tests.
+var send = mail.SendDigest
+
+// Add adds an update to the pending digest of a recipient and saves the pending
+// digests to disk.
+func Add(recipient string, e Entry) (err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	q, ok := pending[recipient]
+	if !ok {
+		q = &queue{Since: e.Time}
+		pending[recipient] = q
+	}
+	q.add(e)
+	return save()
+}
+
+// add adds an update to the queue. An update of a page which is already
+// pending is merged into it, so the digest shows all changes of the page.
+func (q *queue) add(e Entry) {
+	for i := range q.Entries {
+		old := &q.Entries[i]
+		if old.URL != e.URL {
+			continue
+		}
+		if old.Diff != "" && !strings.HasSuffix(old.Diff, "\n") {
+			old.Diff += "\n"
+		}
+		old.Diff += e.Diff
+		old.Name, old.Time, old.Content, old.Fields = e.Name, e.Time, e.Content, e.Fields
+		old.Suppressed += e.Suppressed
+		return
+	}
+	q.Entries = append(q.Entries, e)
+}
+
+// Flush sends the digests which are due at now. Digests which fail to send are
+// kept and retried on the next flush. The digests are sent without holding the
+// lock, so page checks which add updates meanwhile aren't blocked.
+func Flush(now time.Time) (err error) {
+	var errs []string
+
+	// Take the due digests out of the pending digests.
+	due := make(map[string]*queue)
+	mu.Lock()
+	for recipient, q := range pending {
+		sched, err := ScheduleOf(recipient)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if now.Before(sched.Next(q.Since)) {
+			continue
+		}
+		due[recipient] = q
+		delete(pending, recipient)
+	}
+	mu.Unlock()
+	if len(due) == 0 && errs == nil {
+		return nil
+	}
+
+	failed := make(map[string]*queue)
+	for recipient, q := range due {
+		msgs, err := messages(q.Entries)
+		if err == nil {
+			err = send(recipient, msgs)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			failed[recipient] = q
+		}
+	}
+
+	// Put back the digests which failed to send, before any updates which
+	// were added while sending.
+	mu.Lock()
+	for recipient, q := range failed {
+		if added, ok := pending[recipient]; ok {
+			for _, e := range added.Entries {
+				q.add(e)
+			}
+		}
+		pending[recipient] = q
+	}
+	if len(due) > 0 {
+		err = save()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	mu.Unlock()
+
+	if errs != nil {
+		return errutil.NewNoPosf("digest: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// messages returns the mail messages of pending updates.
+func messages(entries []Entry) (msgs []*mail.Message, err error) {
+	for _, e := range entries {
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		msgs = append(msgs, &mail.Message{
+			URL:     u,
+			Name:    e.Name,
+			Time:    e.Time,
+			Diff:    e.Diff,
+			Content: e.Content,
+			Fields:  e.Fields,
+
+			Suppressed: e.Suppressed,
+		})
+	}
+	return msgs, nil
+}
+
+// Run flushes due digests every minute.
+func Run() {
+	for now := range time.Tick(time.Minute) {
+		err := Flush(now)
+		if err != nil {
+			slog.Error("unable to send digests", "err", err)
+		}
+	}
+}
+
+// save saves the pending digests for next execution. The caller must hold mu.
+func save() (err error) {
+	err = settings.SaveGob(settings.DigestPath, pending)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// Load retrieves pending digests from last execution.
+func Load() (err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var p map[string]*queue
+	err = settings.LoadGob(settings.DigestPath, &p)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if p != nil {
+		pending = p
+	}
+	return nil
+}
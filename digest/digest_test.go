@@ -0,0 +1,233 @@
+package digest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/karlek/nyfiken/mail"
+	"github.com/karlek/nyfiken/settings"
+)
+
+func TestParseSchedule(t *testing.T) {
+	golden := []struct {
+		s       string
+		want    Schedule
+		wantErr bool
+	}{
+		// i=0
+		{s: "immediate", want: Schedule{Kind: Immediate}},
+		// i=1
+		{s: "", want: Schedule{Kind: Immediate}},
+		// i=2
+		{s: "Hourly", want: Schedule{Kind: Hourly}},
+		// i=3
+		{s: "daily", want: Schedule{Kind: Daily}},
+		// i=4
+		{s: "daily@08:30", want: Schedule{Kind: Daily, At: 8*time.Hour + 30*time.Minute}},
+		// i=5
+		{s: "daily@25:00", wantErr: true},
+		// i=6
+		{s: "weekly", wantErr: true},
+	}
+
+	for i, g := range golden {
+		got, err := ParseSchedule(g.s)
+		if g.wantErr {
+			if err == nil {
+				t.Errorf("i=%d: expected error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("i=%d: ParseSchedule: %v", i, err)
+			continue
+		}
+		if got != g.want {
+			t.Errorf("i=%d: expected %v, got %v", i, g.want, got)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	at := func(h, m int) time.Time {
+		return time.Date(2014, 3, 1, h, m, 0, 0, time.UTC)
+	}
+	golden := []struct {
+		sched Schedule
+		since time.Time
+		want  time.Time
+	}{
+		// i=0
+		{sched: Schedule{Kind: Immediate}, since: at(10, 15), want: at(10, 15)},
+		// i=1
+		{sched: Schedule{Kind: Hourly}, since: at(10, 15), want: at(11, 0)},
+		// i=2
+		{sched: Schedule{Kind: Daily, At: 8*time.Hour + 30*time.Minute}, since: at(6, 0), want: at(8, 30)},
+		// i=3
+		{sched: Schedule{Kind: Daily, At: 8*time.Hour + 30*time.Minute}, since: at(8, 30), want: at(8, 30).AddDate(0, 0, 1)},
+		// i=4
+		{sched: Schedule{Kind: Daily}, since: at(23, 59), want: at(0, 0).AddDate(0, 0, 1)},
+	}
+
+	for i, g := range golden {
+		got := g.sched.Next(g.since)
+		if !got.Equal(g.want) {
+			t.Errorf("i=%d: expected %v, got %v", i, g.want, got)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-digest")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.DigestPath = filepath.Join(dir, "digest.gob")
+	defer settings.SetGlobal(settings.Global())
+	g := *settings.Global()
+	g.Digest.Default = Hourly
+	g.Digest.Recipients = map[string]string{"team@example.com": "daily@08:30"}
+	settings.SetGlobal(&g)
+
+	sent := make(map[string][]*mail.Message)
+	send = func(recipient string, msgs []*mail.Message) error {
+		sent[recipient] = msgs
+		return nil
+	}
+	defer func() { send = mail.SendDigest }()
+
+	start := time.Date(2014, 3, 1, 10, 15, 0, 0, time.UTC)
+	entries := []struct {
+		recipient string
+		e         Entry
+	}{
+		{"user@example.com", Entry{URL: "http://example.org/a", Name: "a", Time: start, Diff: "+1\n", Suppressed: 1}},
+		{"user@example.com", Entry{URL: "http://example.org/b", Name: "b", Time: start.Add(time.Minute)}},
+		{"user@example.com", Entry{URL: "http://example.org/a", Name: "a", Time: start.Add(2 * time.Minute), Diff: "+2\n", Suppressed: 2}},
+		{"team@example.com", Entry{URL: "http://example.org/a", Name: "a", Time: start}},
+	}
+	for _, x := range entries {
+		err = Add(x.recipient, x.e)
+		if err != nil {
+			t.Fatal("Add:", err)
+		}
+	}
+
+	// Pending digests survive a restart.
+	pending = make(map[string]*queue)
+	err = Load()
+	if err != nil {
+		t.Fatal("Load:", err)
+	}
+
+	// Nothing is due before the start of the next hour.
+	err = Flush(start.Add(30 * time.Minute))
+	if err != nil {
+		t.Fatal("Flush:", err)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("expected no digests, got %v", sent)
+	}
+
+	// The hourly digest is due, with all updates of each page merged.
+	err = Flush(start.Add(45 * time.Minute))
+	if err != nil {
+		t.Fatal("Flush:", err)
+	}
+	msgs := sent["user@example.com"]
+	if len(sent) != 1 || len(msgs) != 2 {
+		t.Fatalf("expected one digest of two pages, got %v", sent)
+	}
+	if msgs[0].Name != "a" || msgs[0].Diff != "+1\n+2\n" || msgs[0].Suppressed != 3 || msgs[1].Name != "b" {
+		t.Errorf("unexpected digest messages %v, %v", msgs[0], msgs[1])
+	}
+
+	// The daily digest is due the next morning.
+	err = Flush(start.AddDate(0, 0, 1).Add(-time.Hour))
+	if err != nil {
+		t.Fatal("Flush:", err)
+	}
+	if len(sent["team@example.com"]) != 1 {
+		t.Errorf("expected daily digest of one page, got %v", sent["team@example.com"])
+	}
+	if len(pending) != 0 {
+		t.Errorf("expected no pending digests, got %d", len(pending))
+	}
+}
+
+func TestFlushFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-digest")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.DigestPath = filepath.Join(dir, "digest.gob")
+	defer settings.SetGlobal(settings.Global())
+	g := *settings.Global()
+	g.Digest.Default = Hourly
+	g.Digest.Recipients = nil
+	settings.SetGlobal(&g)
+	pending = make(map[string]*queue)
+
+	start := time.Date(2014, 3, 1, 10, 15, 0, 0, time.UTC)
+	err = Add("user@example.com", Entry{URL: "http://example.org/a", Time: start, Diff: "+1\n"})
+	if err != nil {
+		t.Fatal("Add:", err)
+	}
+
+	// Updates may be added while the digest is sent, which fails.
+	send = func(recipient string, msgs []*mail.Message) error {
+		err := Add(recipient, Entry{URL: "http://example.org/a", Time: start.Add(time.Hour), Diff: "+2\n"})
+		if err != nil {
+			t.Error("Add:", err)
+		}
+		return errors.New("connection refused")
+	}
+	defer func() { send = mail.SendDigest }()
+
+	err = Flush(start.Add(time.Hour))
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	q := pending["user@example.com"]
+	if q == nil || !q.Since.Equal(start) || len(q.Entries) != 1 || q.Entries[0].Diff != "+1\n+2\n" {
+		t.Errorf("expected the failed digest to be kept with the added update, got %+v", q)
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-digest")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.DigestPath = filepath.Join(dir, "digest.gob")
+
+	// A truncated file is discarded instead of failing the start of nyfikend.
+	err = ioutil.WriteFile(settings.DigestPath, []byte("\x1f\xff\x81"), 0600)
+	if err != nil {
+		t.Fatal("ioutil.WriteFile:", err)
+	}
+	pending = make(map[string]*queue)
+	err = Load()
+	if err != nil {
+		t.Errorf("Load: expected corrupt digests to be discarded, got %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("expected no pending digests, got %d", len(pending))
+	}
+
+	// No temporary file is left behind by a save.
+	err = Add("user@example.com", Entry{URL: "http://example.org/", Time: time.Now()})
+	if err != nil {
+		t.Fatal("Add:", err)
+	}
+	if _, err := os.Stat(settings.DigestPath + ".tmp"); !os.IsNotExist(err) {
+		t.Error("expected temporary file to be renamed")
+	}
+}
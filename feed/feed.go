@@ -0,0 +1,312 @@
+// Package feed records detected updates and serves them as Atom and RSS feeds.
+package feed
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karlek/nyfiken/logging"
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// MaxEntries is the number of most recent updates kept in the feed.
+const MaxEntries = 200
+
+// Entry is a detected update of a page.
+type Entry struct {
+	URL     string    // URL of the updated page.
+	Name    string    // Name of the page.
+	Time    time.Time // Time of detection.
+	Content string    // Differing lines, or the new content if unavailable.
+	Tags    []string  // Tags of the page.
+}
+
+// entries are the recorded updates, oldest first.
+var (
+	mu      sync.Mutex
+	entries []Entry
+)
+
+// Add records an update and saves the feed to disk.
+func Add(e Entry) (err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	entries = append(entries, e)
+	if len(entries) > MaxEntries {
+		entries = entries[len(entries)-MaxEntries:]
+	}
+	return save()
+}
+
+// Entries returns the recorded updates of the page with the URL, newest first.
+func Entries(rawurl string) (es []Entry) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].URL == rawurl {
+			es = append(es, entries[i])
+		}
+	}
+	return es
+}
+
+// save saves the recorded updates for next execution. The caller must hold mu.
+func save() (err error) {
+	err = settings.SaveGob(settings.FeedPath, entries)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// Load retrieves recorded updates from last execution.
+func Load() (err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var es []Entry
+	err = settings.LoadGob(settings.FeedPath, &es)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	entries = es
+	return nil
+}
+
+// Listen makes nyfikend serve the feeds on the feed address.
+func Listen() {
+	srv := &http.Server{Addr: settings.Global().FeedAddr, Handler: Handler()}
+	serverMu.Lock()
+	server = srv
+	serverMu.Unlock()
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		logging.Fatal("unable to serve feeds", "err", err)
+	}
+}
+
+// server is the server of Listen, which Shutdown shuts down.
+var (
+	serverMu sync.Mutex
+	server   *http.Server
+)
+
+// Shutdown stops serving feeds, and waits for active requests until the
+// context is done.
+func Shutdown(ctx context.Context) (err error) {
+	serverMu.Lock()
+	srv := server
+	serverMu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// Handler returns an HTTP handler which serves the Atom feed of all updates at
+// "/" and the Atom feeds of tagged pages at "/tag/<tag>". The same feeds are
+// served as RSS 2.0 below "/rss".
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		serveAtom(w, r, "")
+	})
+	mux.HandleFunc("/tag/", func(w http.ResponseWriter, r *http.Request) {
+		tag := strings.TrimPrefix(r.URL.Path, "/tag/")
+		if tag == "" {
+			http.NotFound(w, r)
+			return
+		}
+		serveAtom(w, r, tag)
+	})
+	mux.HandleFunc("/rss", func(w http.ResponseWriter, r *http.Request) {
+		serveRSS(w, r, "")
+	})
+	mux.HandleFunc("/rss/tag/", func(w http.ResponseWriter, r *http.Request) {
+		tag := strings.TrimPrefix(r.URL.Path, "/rss/tag/")
+		if tag == "" {
+			http.NotFound(w, r)
+			return
+		}
+		serveRSS(w, r, tag)
+	})
+	return mux
+}
+
+// Atom feed elements as specified by RFC 4287.
+type (
+	atomFeed struct {
+		XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+		Title   string      `xml:"title"`
+		ID      string      `xml:"id"`
+		Updated string      `xml:"updated"`
+		Author  atomAuthor  `xml:"author"`
+		Link    atomLink    `xml:"link"`
+		Entries []atomEntry `xml:"entry"`
+	}
+	atomAuthor struct {
+		Name string `xml:"name"`
+	}
+	atomLink struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr,omitempty"`
+	}
+	atomEntry struct {
+		Title   string      `xml:"title"`
+		ID      string      `xml:"id"`
+		Updated string      `xml:"updated"`
+		Link    atomLink    `xml:"link"`
+		Content atomContent `xml:"content"`
+	}
+	atomContent struct {
+		Type string `xml:"type,attr"`
+		Body string `xml:",chardata"`
+	}
+)
+
+// RSS 2.0 feed elements.
+type (
+	rssFeed struct {
+		XMLName xml.Name   `xml:"rss"`
+		Version string     `xml:"version,attr"`
+		Channel rssChannel `xml:"channel"`
+	}
+	rssChannel struct {
+		Title         string    `xml:"title"`
+		Link          string    `xml:"link"`
+		Description   string    `xml:"description"`
+		LastBuildDate string    `xml:"lastBuildDate"`
+		Items         []rssItem `xml:"item"`
+	}
+	rssItem struct {
+		Title       string  `xml:"title"`
+		Link        string  `xml:"link"`
+		GUID        rssGUID `xml:"guid"`
+		PubDate     string  `xml:"pubDate"`
+		Description string  `xml:"description"`
+	}
+	rssGUID struct {
+		IsPermaLink bool   `xml:"isPermaLink,attr"`
+		ID          string `xml:",chardata"`
+	}
+)
+
+// feedInfo returns the title and ID of the feed of all updates, or of the
+// updates of pages with the provided tag.
+func feedInfo(tag string) (title, id string) {
+	title, id = "nyfiken", "urn:nyfiken:feed"
+	if tag != "" {
+		title += ": " + tag
+		id += ":tag:" + tag
+	}
+	return title, id
+}
+
+// tagged returns the updates, or the updates of pages with the provided tag,
+// newest first.
+func tagged(tag string) (es []Entry) {
+	mu.Lock()
+	defer mu.Unlock()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if tag == "" || hasTag(entries[i].Tags, tag) {
+			es = append(es, entries[i])
+		}
+	}
+	return es
+}
+
+// entryID returns the unique ID of an update.
+func entryID(e Entry) string {
+	return fmt.Sprintf("urn:nyfiken:%s:%d", e.URL, e.Time.UnixNano())
+}
+
+// serveAtom writes the Atom feed of all updates, or of the updates of pages
+// with the provided tag, newest first.
+func serveAtom(w http.ResponseWriter, r *http.Request, tag string) {
+	title, id := feedInfo(tag)
+	f := atomFeed{
+		Title:   title,
+		ID:      id,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: "nyfiken"},
+		Link:    atomLink{Href: "http://" + r.Host + r.URL.Path, Rel: "self"},
+	}
+	for _, e := range tagged(tag) {
+		f.Entries = append(f.Entries, atomEntry{
+			Title:   e.Name + " has been updated",
+			ID:      entryID(e),
+			Updated: e.Time.UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: e.URL},
+			Content: atomContent{Type: "text", Body: e.Content},
+		})
+	}
+	if len(f.Entries) > 0 {
+		f.Updated = f.Entries[0].Updated
+	}
+	write(w, "application/atom+xml; charset=utf-8", f)
+}
+
+// serveRSS writes the RSS feed of all updates, or of the updates of pages with
+// the provided tag, newest first.
+func serveRSS(w http.ResponseWriter, r *http.Request, tag string) {
+	title, _ := feedInfo(tag)
+	f := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         title,
+			Link:          "http://" + r.Host + r.URL.Path,
+			Description:   "Updates of pages checked by nyfiken.",
+			LastBuildDate: time.Now().UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, e := range tagged(tag) {
+		f.Channel.Items = append(f.Channel.Items, rssItem{
+			Title:       e.Name + " has been updated",
+			Link:        e.URL,
+			GUID:        rssGUID{ID: entryID(e)},
+			PubDate:     e.Time.UTC().Format(time.RFC1123Z),
+			Description: e.Content,
+		})
+	}
+	if len(f.Channel.Items) > 0 {
+		f.Channel.LastBuildDate = f.Channel.Items[0].PubDate
+	}
+	write(w, "application/rss+xml; charset=utf-8", f)
+}
+
+// write writes the XML encoded feed.
+func write(w http.ResponseWriter, contentType string, f interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(xml.Header))
+	err := xml.NewEncoder(w).Encode(f)
+	if err != nil {
+		slog.Error("unable to write feed", "err", err)
+	}
+}
+
+// hasTag reports whether tags contains tag.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package feed
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karlek/nyfiken/settings"
+)
+
+func TestHandler(t *testing.T) {
+	entries = []Entry{
+		{URL: "http://example.org/", Name: "example", Time: time.Unix(1, 0), Content: "+news\n", Tags: []string{"news"}},
+		{URL: "http://another.example.org/", Name: "another", Time: time.Unix(2, 0), Content: "+work\n", Tags: []string{"work"}},
+		{URL: "http://third.example.org/", Name: "third", Time: time.Unix(3, 0), Content: "+both\n", Tags: []string{"news", "work"}},
+	}
+
+	var golden = []struct {
+		path string
+		want []string
+	}{
+		{"/", []string{"http://third.example.org/", "http://another.example.org/", "http://example.org/"}},
+		{"/tag/news", []string{"http://third.example.org/", "http://example.org/"}},
+		{"/tag/work", []string{"http://third.example.org/", "http://another.example.org/"}},
+		{"/tag/none", nil},
+		{"/rss", []string{"http://third.example.org/", "http://another.example.org/", "http://example.org/"}},
+		{"/rss/tag/news", []string{"http://third.example.org/", "http://example.org/"}},
+		{"/rss/tag/none", nil},
+	}
+
+	h := Handler()
+	for _, g := range golden {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", g.path, nil))
+
+		var got []string
+		if strings.HasPrefix(g.path, "/rss") {
+			var f rssFeed
+			err := xml.Unmarshal(w.Body.Bytes(), &f)
+			if err != nil {
+				t.Errorf("%s: xml.Unmarshal: %v", g.path, err)
+				continue
+			}
+			for _, item := range f.Channel.Items {
+				got = append(got, item.Link)
+			}
+		} else {
+			var f atomFeed
+			err := xml.Unmarshal(w.Body.Bytes(), &f)
+			if err != nil {
+				t.Errorf("%s: xml.Unmarshal: %v", g.path, err)
+				continue
+			}
+			for _, e := range f.Entries {
+				got = append(got, e.Link.Href)
+			}
+		}
+		if len(got) != len(g.want) {
+			t.Errorf("%s: output %v != expected %v", g.path, got, g.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != g.want[i] {
+				t.Errorf("%s: output %v != expected %v", g.path, got, g.want)
+				break
+			}
+		}
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-feed")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.FeedPath = filepath.Join(dir, "feed.gob")
+
+	entries = []Entry{{URL: "http://example.org/", Name: "example", Time: time.Unix(1, 0)}}
+	err = save()
+	if err != nil {
+		t.Fatal("save:", err)
+	}
+	entries = nil
+	err = Load()
+	if err != nil {
+		t.Fatal("Load:", err)
+	}
+	if len(entries) != 1 || entries[0].URL != "http://example.org/" {
+		t.Errorf("unexpected entries %v", entries)
+	}
+
+	// A truncated feed is discarded instead of failing the start of nyfikend.
+	buf, err := ioutil.ReadFile(settings.FeedPath)
+	if err != nil {
+		t.Fatal("ioutil.ReadFile:", err)
+	}
+	err = ioutil.WriteFile(settings.FeedPath, buf[:len(buf)/2], 0600)
+	if err != nil {
+		t.Fatal("ioutil.WriteFile:", err)
+	}
+	err = Load()
+	if err != nil {
+		t.Errorf("Load: expected corrupt feed to be discarded, got %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no entries, got %v", entries)
+	}
+}
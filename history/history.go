@@ -0,0 +1,168 @@
+// Package history keeps recent snapshots and notifications of pages, to
+// suppress notifications about pages which flap between states and to limit
+// the rate of notifications.
+package history
+
+import (
+	"crypto/sha256"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Limits specify when notifications of a page are suppressed.
+type Limits struct {
+	Snapshots int           // Number of recent snapshots a flapping page returns to; zero to disable.
+	Rate      int           // Number of notifications per window; zero to disable.
+	Window    time.Duration // Duration of the rate limit window.
+}
+
+// SummaryWindow is the duration after the first suppressed notification of a
+// page without a rate limit window, after which its suppressed notifications
+// are summarized.
+const SummaryWindow = time.Hour
+
+// record is the history of a page.
+type record struct {
+	Hashes     [][sha256.Size]byte // Hashes of recent snapshots, oldest first.
+	Notified   []time.Time         // Times of notifications within the window.
+	Suppressed int                 // Number of suppressed notifications since the last one.
+	Since      time.Time           // Time of the first suppressed notification since the last one.
+	Window     time.Duration       // Duration after Since when the suppressed notifications are summarized.
+}
+
+// Summary describes the suppressed notifications of a page.
+type Summary struct {
+	URL        string    // URL of the page.
+	Suppressed int       // Number of suppressed notifications.
+	Since      time.Time // Time of the first suppressed notification.
+}
+
+// records are the histories by page URL.
+var (
+	mu      sync.Mutex
+	records = make(map[string]*record)
+)
+
+// Check records an update of a page from the previous to the current snapshot
+// at now and reports whether it should be notified. The update isn't notified
+// if the current snapshot equals one of the recent snapshots, or if the rate
+// limit has been reached. When notified, suppressed is the number of suppressed
+// notifications since the last one.
+func Check(url, prev, cur string, now time.Time, l Limits) (notify bool, suppressed int, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	r, ok := records[url]
+	if !ok {
+		r = new(record)
+		records[url] = r
+	}
+
+	// Detect flapping.
+	var flapping bool
+	if l.Snapshots > 0 {
+		prevHash, curHash := sha256.Sum256([]byte(prev)), sha256.Sum256([]byte(cur))
+		if n := len(r.Hashes); n == 0 || r.Hashes[n-1] != prevHash {
+			r.Hashes = append(r.Hashes, prevHash)
+		}
+		for _, h := range r.Hashes {
+			if h == curHash {
+				flapping = true
+				break
+			}
+		}
+		r.Hashes = append(r.Hashes, curHash)
+		if len(r.Hashes) > l.Snapshots {
+			r.Hashes = r.Hashes[len(r.Hashes)-l.Snapshots:]
+		}
+	} else {
+		r.Hashes = nil
+	}
+
+	// Forget notifications outside of the window.
+	var notified []time.Time
+	for _, t := range r.Notified {
+		if now.Sub(t) < l.Window {
+			notified = append(notified, t)
+		}
+	}
+	r.Notified = notified
+	limited := l.Rate > 0 && len(r.Notified) >= l.Rate
+
+	if flapping || limited {
+		if r.Suppressed == 0 {
+			r.Since = now
+		}
+		r.Suppressed++
+		r.Window = l.Window
+		if r.Window <= 0 {
+			r.Window = SummaryWindow
+		}
+	} else {
+		notify, suppressed = true, r.Suppressed
+		r.Notified = append(r.Notified, now)
+		r.Suppressed, r.Since = 0, time.Time{}
+	}
+
+	err = save()
+	if err != nil {
+		return false, 0, errutil.Err(err)
+	}
+	return notify, suppressed, nil
+}
+
+// Summaries returns the summaries of the pages whose suppressed notifications
+// are due at now, i.e. once the window has passed since the first of them
+// without any later notification, and records the summaries as notifications.
+func Summaries(now time.Time) (ss []Summary, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for url, r := range records {
+		if r.Suppressed == 0 || now.Sub(r.Since) < r.Window {
+			continue
+		}
+		ss = append(ss, Summary{URL: url, Suppressed: r.Suppressed, Since: r.Since})
+		r.Notified = append(r.Notified, now)
+		r.Suppressed, r.Since = 0, time.Time{}
+	}
+	if len(ss) == 0 {
+		return nil, nil
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].URL < ss[j].URL })
+
+	err = save()
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return ss, nil
+}
+
+// save saves the histories for next execution. The caller must hold mu.
+func save() (err error) {
+	err = settings.SaveGob(settings.HistoryPath, records)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// Load retrieves the histories from last execution.
+func Load() (err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var rs map[string]*record
+	err = settings.LoadGob(settings.HistoryPath, &rs)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if rs != nil {
+		records = rs
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/karlek/nyfiken/settings"
+)
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-history")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.HistoryPath = filepath.Join(dir, "history.gob")
+
+	start := time.Date(2014, 3, 1, 10, 0, 0, 0, time.UTC)
+	golden := []struct {
+		url            string
+		prev, cur      string
+		after          time.Duration
+		limits         Limits
+		wantNotify     bool
+		wantSuppressed int
+	}{
+		// Flapping between A and B.
+		// i=0
+		{url: "a", prev: "A", cur: "B", limits: Limits{Snapshots: 3}, wantNotify: true},
+		// i=1
+		{url: "a", prev: "B", cur: "A", limits: Limits{Snapshots: 3}},
+		// i=2
+		{url: "a", prev: "A", cur: "B", limits: Limits{Snapshots: 3}},
+		// i=3
+		{url: "a", prev: "B", cur: "C", limits: Limits{Snapshots: 3}, wantNotify: true, wantSuppressed: 2},
+		// A has been forgotten after 3 snapshots; B, C and D.
+		// i=4
+		{url: "a", prev: "C", cur: "D", limits: Limits{Snapshots: 3}, wantNotify: true},
+		// i=5
+		{url: "a", prev: "D", cur: "A", limits: Limits{Snapshots: 3}, wantNotify: true},
+
+		// At most 2 notifications per hour.
+		// i=6
+		{url: "b", prev: "1", cur: "2", limits: Limits{Rate: 2, Window: time.Hour}, wantNotify: true},
+		// i=7
+		{url: "b", prev: "2", cur: "3", after: 10 * time.Minute, limits: Limits{Rate: 2, Window: time.Hour}, wantNotify: true},
+		// i=8
+		{url: "b", prev: "3", cur: "4", after: 20 * time.Minute, limits: Limits{Rate: 2, Window: time.Hour}},
+		// i=9
+		{url: "b", prev: "4", cur: "5", after: 30 * time.Minute, limits: Limits{Rate: 2, Window: time.Hour}},
+		// i=10
+		{url: "b", prev: "5", cur: "6", after: 65 * time.Minute, limits: Limits{Rate: 2, Window: time.Hour}, wantNotify: true, wantSuppressed: 2},
+	}
+
+	for i, g := range golden {
+		notify, suppressed, err := Check(g.url, g.prev, g.cur, start.Add(g.after), g.limits)
+		if err != nil {
+			t.Errorf("i=%d: Check: %v", i, err)
+			continue
+		}
+		if notify != g.wantNotify {
+			t.Errorf("i=%d: notify: expected %v, got %v", i, g.wantNotify, notify)
+		}
+		if suppressed != g.wantSuppressed {
+			t.Errorf("i=%d: suppressed: expected %d, got %d", i, g.wantSuppressed, suppressed)
+		}
+	}
+
+	// The history survives a restart.
+	records = make(map[string]*record)
+	err = Load()
+	if err != nil {
+		t.Fatal("Load:", err)
+	}
+	if r := records["b"]; r == nil || len(r.Notified) != 2 {
+		t.Errorf("expected 2 recent notifications of b, got %v", r)
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-history")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.HistoryPath = filepath.Join(dir, "history.gob")
+
+	// A truncated file is discarded instead of failing the start of nyfikend.
+	err = ioutil.WriteFile(settings.HistoryPath, []byte("\x1f\xff\x81"), 0600)
+	if err != nil {
+		t.Fatal("ioutil.WriteFile:", err)
+	}
+	records = make(map[string]*record)
+	err = Load()
+	if err != nil {
+		t.Errorf("Load: expected corrupt history to be discarded, got %v", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("expected no records, got %d", len(records))
+	}
+}
+
+func TestSummaries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-history")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.HistoryPath = filepath.Join(dir, "history.gob")
+	records = make(map[string]*record)
+
+	// The page is notified once, and then rate limited twice.
+	start := time.Date(2014, 3, 1, 10, 0, 0, 0, time.UTC)
+	limits := Limits{Rate: 1, Window: time.Hour}
+	for i, cur := range []string{"2", "3", "4"} {
+		_, _, err = Check("a", "1", cur, start.Add(time.Duration(i)*10*time.Minute), limits)
+		if err != nil {
+			t.Fatal("Check:", err)
+		}
+	}
+	// The flapping page without a rate limit is summarized after the
+	// summary window.
+	for i, cur := range []string{"B", "A"} {
+		_, _, err = Check("b", string("AB"[i]), cur, start.Add(40*time.Minute+time.Duration(i)*time.Minute), Limits{Snapshots: 3})
+		if err != nil {
+			t.Fatal("Check:", err)
+		}
+	}
+
+	golden := []struct {
+		after time.Duration
+		want  []Summary
+	}{
+		// i=0
+		{after: 30 * time.Minute},
+		// i=1
+		{after: 70 * time.Minute, want: []Summary{{URL: "a", Suppressed: 2, Since: start.Add(10 * time.Minute)}}},
+		// i=2
+		{after: 70 * time.Minute},
+		// i=3
+		{after: 2 * time.Hour, want: []Summary{{URL: "b", Suppressed: 1, Since: start.Add(41 * time.Minute)}}},
+	}
+
+	for i, g := range golden {
+		got, err := Summaries(start.Add(g.after))
+		if err != nil {
+			t.Errorf("i=%d: Summaries: %v", i, err)
+			continue
+		}
+		if len(got) != len(g.want) {
+			t.Errorf("i=%d: expected %v, got %v", i, g.want, got)
+			continue
+		}
+		for j := range got {
+			if got[j] != g.want[j] {
+				t.Errorf("i=%d: expected %v, got %v", i, g.want, got)
+				break
+			}
+		}
+	}
+
+	// The summary counts against the rate limit.
+	notify, _, err := Check("a", "4", "5", start.Add(80*time.Minute), limits)
+	if err != nil {
+		t.Fatal("Check:", err)
+	}
+	if notify {
+		t.Error("expected notification after the summary to be rate limited")
+	}
+}
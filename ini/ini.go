@@ -2,15 +2,26 @@
 package ini
 
 import (
-	"fmt"
+	"log/slog"
+	"net"
 	"net/url"
 	"os"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
+	"code.google.com/p/cascadia"
 	"github.com/jteeuwen/ini"
+	"github.com/karlek/nyfiken/digest"
+	"github.com/karlek/nyfiken/logging"
+	nmail "github.com/karlek/nyfiken/mail"
+	"github.com/karlek/nyfiken/notify"
 	"github.com/karlek/nyfiken/page"
+	"github.com/karlek/nyfiken/secret"
 	"github.com/karlek/nyfiken/settings"
+	"github.com/karlek/nyfiken/strip"
 	"github.com/mewkiz/pkg/errutil"
 )
 
@@ -18,39 +29,98 @@ import (
 const (
 	sectionSettings = "settings"
 	sectionMail     = "mail"
+	sectionWebhook  = "webhook"
+	sectionDigest   = "digest"
+
+	// Prefix of sections of named notification targets (i.e. [notify name]).
+	sectionNotifyPrefix = "notify "
 )
 
 // INI field names.
 const (
-	fieldBrowser        = "browser"
-	fieldFilePerms      = "fileperms"
-	fieldHeader         = "header"
-	fieldInterval       = "interval"
-	fieldNegexp         = "negexp"
-	fieldPortNum        = "portnum"
-	fieldRecvMail       = "recvmail"
-	fieldRegexp         = "regexp"
-	fieldSelection      = "sel"
-	fieldSendAuthServer = "sendauthserver"
-	fieldSendMail       = "sendmail"
-	fieldSendOutServer  = "sendoutserver"
-	fieldSendPass       = "sendpass"
-	fieldSleepStart     = "sleepstart"
-	fieldStrip          = "strip"
-	fieldThreshold      = "threshold"
+	fieldBrowser         = "browser"
+	fieldCommand         = "command"
+	fieldDigest          = "digest"
+	fieldExclude         = "exclude"
+	fieldExecTimeout     = "exectimeout"
+	fieldExtract         = "extract"
+	fieldFeedAddr        = "feedaddr"
+	fieldField           = "field"
+	fieldFlapLimit       = "flaplimit"
+	fieldFilePerms       = "fileperms"
+	fieldFingerprint     = "fingerprint"
+	fieldHeader          = "header"
+	fieldSecretHeader    = "secretheader"
+	fieldHTTPAddr        = "httpaddr"
+	fieldInterval        = "interval"
+	fieldLogBackups      = "logbackups"
+	fieldLogFile         = "logfile"
+	fieldLogFormat       = "logformat"
+	fieldLogLevel        = "loglevel"
+	fieldLogMaxSize      = "logmaxsize"
+	fieldMarkRead        = "markread"
+	fieldName            = "name"
+	fieldNegexp          = "negexp"
+	fieldNotify          = "notify"
+	fieldOnUpdate        = "on_update"
+	fieldOnUpdateTimeout = "on_update_timeout"
+	fieldPortNum         = "portnum"
+	fieldRateLimit       = "ratelimit"
+	fieldRecvMail        = "recvmail"
+	fieldRegexp          = "regexp"
+	fieldRetries         = "retries"
+	fieldSecurity        = "security"
+	fieldSelection       = "sel"
+	fieldAttach          = "attach"
+	fieldAuth            = "auth"
+	fieldHTMLTemplate    = "htmltemplate"
+	fieldSubject         = "subject"
+	fieldTextTemplate    = "texttemplate"
+	fieldSendAuthServer  = "sendauthserver"
+	fieldSendMail        = "sendmail"
+	fieldSendOutServer   = "sendoutserver"
+	fieldSendPass        = "sendpass"
+	fieldSleepStart      = "sleepstart"
+	fieldSocket          = "socket"
+	fieldStrip           = "strip"
+	fieldTag             = "tag"
+	fieldTemplate        = "template"
+	fieldThreshold       = "threshold"
+	fieldTLS             = "tls"
+	fieldTokenFile       = "tokenfile"
+	fieldTimeout         = "timeout"
+	fieldTo              = "to"
+	fieldType            = "type"
+	fieldURL             = "url"
+	fieldWebhook         = "webhook"
+	fieldSecretWebhook   = "secretwebhook"
+	fieldWebUI           = "webui"
 )
 
 var (
 	// Valid fields in different sections
 	siteFields = map[string]bool{
-		fieldInterval:  true,
-		fieldStrip:     true,
-		fieldRecvMail:  true,
-		fieldSelection: true,
-		fieldRegexp:    true,
-		fieldNegexp:    true,
-		fieldThreshold: true,
-		fieldHeader:    true,
+		fieldInterval:      true,
+		fieldStrip:         true,
+		fieldRecvMail:      true,
+		fieldSelection:     true,
+		fieldRegexp:        true,
+		fieldNegexp:        true,
+		fieldThreshold:     true,
+		fieldHeader:        true,
+		fieldSecretHeader:  true,
+		fieldExclude:       true,
+		fieldExtract:       true,
+		fieldField:         true,
+		fieldName:          true,
+		fieldWebhook:       true,
+		fieldSecretWebhook: true,
+		fieldOnUpdate:      true,
+		fieldTag:           true,
+		fieldMarkRead:      true,
+		fieldNotify:        true,
+		fieldFlapLimit:     true,
+		fieldRateLimit:     true,
 	}
 	mailFields = map[string]bool{
 		fieldRecvMail:       true,
@@ -58,12 +128,52 @@ var (
 		fieldSendPass:       true,
 		fieldSendAuthServer: true,
 		fieldSendOutServer:  true,
+		fieldSecurity:       true,
+		fieldAuth:           true,
+		fieldSubject:        true,
+		fieldTextTemplate:   true,
+		fieldHTMLTemplate:   true,
+		fieldAttach:         true,
+		fieldDigest:         true,
+	}
+	webhookFields = map[string]bool{
+		fieldURL:      true,
+		fieldTemplate: true,
+		fieldRetries:  true,
 	}
 	settingsFields = map[string]bool{
-		fieldInterval:  true,
-		fieldBrowser:   true,
-		fieldPortNum:   true,
-		fieldFilePerms: true,
+		fieldInterval:        true,
+		fieldBrowser:         true,
+		fieldPortNum:         true,
+		fieldSocket:          true,
+		fieldTokenFile:       true,
+		fieldTLS:             true,
+		fieldFingerprint:     true,
+		fieldFilePerms:       true,
+		fieldExecTimeout:     true,
+		fieldOnUpdate:        true,
+		fieldOnUpdateTimeout: true,
+		fieldFeedAddr:        true,
+		fieldHTTPAddr:        true,
+		fieldWebUI:           true,
+		fieldMarkRead:        true,
+		fieldNotify:          true,
+		fieldFlapLimit:       true,
+		fieldRateLimit:       true,
+		fieldLogLevel:        true,
+		fieldLogFormat:       true,
+		fieldLogFile:         true,
+		fieldLogMaxSize:      true,
+		fieldLogBackups:      true,
+	}
+	targetFields = map[string]bool{
+		fieldType:     true,
+		fieldTo:       true,
+		fieldURL:      true,
+		fieldTemplate: true,
+		fieldRetries:  true,
+		fieldCommand:  true,
+		fieldTimeout:  true,
 	}
 )
 
@@ -74,70 +184,240 @@ var (
 	errNoSectionMail          = "ini: no [" + sectionMail + "] section found in config.ini."
 	errInvalidMailAddress     = "ini: invalid mail: `%s`; correct syntax -> `name@domain.tld`."
 	errInvalidHeader          = "ini: invalid header: `%s`; correct syntax -> `HeaderName: Value`."
+	errInvalidSecretHeader    = "ini: invalid secret header: `%s`; correct syntax -> `HeaderName: env:NAME`, `file:path` or `cmd:command`."
+	errInvalidSecretWebhook   = "ini: invalid secret webhook: `%s`; correct syntax -> `env:NAME`, `file:path` or `cmd:command`."
 	errInvalidStripFunction   = "ini: invalid strip function: `%s`."
+	errInvalidSelector        = "ini: invalid CSS selector: `%s`; %v."
+	errInvalidRegexp          = "ini: invalid regular expression: `%s`; %v."
+	errInvalidExtract         = "ini: invalid extraction mode: `%s`; correct syntax -> `html`, `text` or `attr:name`."
+	errInvalidField           = "ini: invalid field: `%s`; correct syntax -> `name: selector | extract`."
+	errInvalidLogFormat       = "ini: invalid log format `%s`; correct syntax -> `text` or `json`."
 	errInvalidRandInterval    = "ini: invalid random interval: %s; correct syntax -> `duration duration`."
 	errMailAddressNotFound    = "ini: global receiving mail required."
 	errMailAuthServerNotFound = "ini: sending mail authorization server required."
 	errMailOutServerNotFound  = "ini: sending mail outgoing server required."
+	errInvalidMailSecurity    = "ini: invalid mail security: `%s`; correct syntax -> `tls`, `starttls` or `none`."
+	errInvalidMailAuth        = "ini: invalid mail authentication: `%s`; correct syntax -> `plain`, `login`, `cram-md5` or `none`."
+	errUnencryptedMailAuth    = "ini: refusing to send the mail password unencrypted to `%s`; use `security = tls` or `starttls`."
 	errInvalidListDeclaration = "ini: use `<` instead of `=` for list values."
+	errWebhookURLNotFound     = "ini: webhook URL required."
+	errWorldReadableSecret    = "ini: %s is readable by everyone and contains a literal secret in `%s`; run `chmod o-r %s` or use a `env:`, `file:` or `cmd:` reference."
+	errInvalidTargetType      = "ini: invalid notification target type: `%s`; correct syntax -> `mail`, `webhook` or `command`."
+	errTargetFieldNotFound    = "ini: notification target `%s` requires field `%s`."
+	errTargetMailNoSender     = "ini: mail notification target `%s` requires a [" + sectionMail + "] section."
+	errUnknownTarget          = "ini: unknown notification target: `%s`; define it in a [" + sectionNotifyPrefix + "%s] section."
+	errInvalidRateLimit       = "ini: invalid rate limit: `%s`; correct syntax -> `count/duration`, e.g. `3/1h`."
+	errInvalidWebhookURL      = "ini: invalid webhook URL: `%s`; correct syntax -> `http://host/path`."
 )
 
-// Whitelist of allowed strip functions.
-var (
-	stripFunctions = map[string]bool{
-		"html":    true,
-		"attrs":   true,
-		"numbers": true,
-		"scripts": true,
-	}
-)
-
-// ReadIni is a convenience function wrapping ReadSettings and ReadPages.
+// ReadIni is a convenience function wrapping ParseSettings and ParsePages. The
+// settings are only replaced if both files are valid.
 func ReadIni(configPath, pagesPath string) (pages []*page.Page, err error) {
 	// Read config.
-	err = ReadSettings(configPath)
+	global, err := ParseSettings(configPath)
 	if err != nil {
 		return nil, errutil.Err(err)
 	}
 
 	// Read pages file.
-	pages, err = ReadPages(pagesPath)
+	pages, err = ParsePages(pagesPath, global)
 	if err != nil {
 		return nil, errutil.Err(err)
 	}
 
+	settings.SetGlobal(global)
 	return pages, nil
 }
 
-// ReadSettings reads settings file and updates settings.Global.
+// secretHeaders are the HTTP headers whose values are considered secrets.
+var secretHeaders = map[string]bool{
+	"authorization":       true,
+	"cookie":              true,
+	"proxy-authorization": true,
+}
+
+// CheckSecrets returns an error if the settings file or the pages file is
+// readable by everyone and contains a literal secret rather than a reference to
+// a secret; the mail password, webhook URLs or the values of authorization and
+// cookie headers.
+func CheckSecrets(configPath, pagesPath string) (err error) {
+	if runtime.GOOS == "windows" {
+		// File modes don't reflect access control lists.
+		return nil
+	}
+
+	// Check the secrets of the settings file.
+	file, err := loadReadable(configPath)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if file != nil {
+		for name, section := range file.Sections {
+			var field string
+			switch {
+			case name == sectionMail:
+				field = fieldSendPass
+			case name == sectionWebhook, strings.HasPrefix(name, sectionNotifyPrefix):
+				field = fieldURL
+			default:
+				continue
+			}
+			if v := section.S(field, ""); v != "" && !secret.IsRef(v) {
+				return errutil.NewNoPosf(errWorldReadableSecret, configPath, "["+name+"] "+field, configPath)
+			}
+		}
+	}
+
+	// Check the secrets of the pages file.
+	file, err = loadReadable(pagesPath)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if file == nil {
+		return nil
+	}
+	for name, section := range file.Sections {
+		if section.S(fieldWebhook, "") != "" {
+			return errutil.NewNoPosf(errWorldReadableSecret, pagesPath, "["+name+"] "+fieldWebhook, pagesPath)
+		}
+		for _, header := range section.List(fieldHeader) {
+			key := strings.TrimSpace(strings.SplitN(header, ":", 2)[0])
+			if secretHeaders[strings.ToLower(key)] {
+				return errutil.NewNoPosf(errWorldReadableSecret, pagesPath, "["+name+"] "+fieldHeader+" "+key, pagesPath)
+			}
+		}
+	}
+	return nil
+}
+
+// loadReadable loads the ini file at path if it's readable by everyone, and
+// returns nil otherwise.
+func loadReadable(path string) (file *ini.File, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	if fi.Mode().Perm()&0004 == 0 {
+		return nil, nil
+	}
+	file = ini.New()
+	err = file.Load(path)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return file, nil
+}
+
+// ReadSettings reads settings file and replaces the global settings.
 func ReadSettings(configPath string) (err error) {
+	global, err := ParseSettings(configPath)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	settings.SetGlobal(global)
+	return nil
+}
+
+// ParseSettings reads settings file and returns new global settings, where
+// settings missing from the file have their default values.
+func ParseSettings(configPath string) (global *settings.Prog, err error) {
 	// Parse config file.
 	file := ini.New()
 	err = file.Load(configPath)
 	if err != nil {
-		return errutil.Err(err)
+		return nil, errutil.Err(err)
 	}
 
+	global = settings.Defaults()
+
 	config, settingExist := file.Sections[sectionSettings]
 	mail, mailExist := file.Sections[sectionMail]
 	if settingExist {
-		err = parseSettings(config)
+		err = parseSettings(global, config)
 		if err != nil {
-			return errutil.Err(err)
+			return nil, errutil.Err(err)
 		}
 	}
 	if mailExist {
-		err = parseMail(mail)
+		err = parseMail(global, mail)
 		if err != nil {
-			return errutil.Err(err)
+			return nil, errutil.Err(err)
+		}
+	}
+	if webhook, found := file.Sections[sectionWebhook]; found {
+		err = parseWebhook(global, webhook)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+	}
+	if d, found := file.Sections[sectionDigest]; found {
+		err = parseDigest(global, d)
+		if err != nil {
+			return nil, errutil.Err(err)
 		}
 	}
 
+	// Parse named notification targets.
+	targets := make(map[string]settings.Target)
+	for sectionName, section := range file.Sections {
+		if !strings.HasPrefix(sectionName, sectionNotifyPrefix) {
+			continue
+		}
+		name := strings.TrimSpace(strings.TrimPrefix(sectionName, sectionNotifyPrefix))
+		targets[name], err = parseTarget(global, name, section)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+	}
+	global.Targets = targets
+	for _, name := range global.Notify {
+		if _, found := targets[name]; !found {
+			return nil, errutil.NewNoPosf(errUnknownTarget, name, name)
+		}
+	}
+	if mailExist && global.RecvMail == "" && len(targets) == 0 {
+		return nil, errutil.NewNoPosf(errMailAddressNotFound)
+	}
+
+	return global, nil
+}
+
+// ReadClientSettings reads the settings of nyfikenc from the settings file into
+// the global settings; the address of nyfikend, the authentication and the
+// browser. Unlike ReadSettings it neither resolves secrets nor validates the
+// settings of nyfikend.
+func ReadClientSettings(configPath string) (err error) {
+	file := ini.New()
+	err = file.Load(configPath)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	global := settings.Defaults()
+	if config, found := file.Sections[sectionSettings]; found {
+		parseClientSettings(global, config)
+	}
+	settings.SetGlobal(global)
 	return nil
 }
 
+// Parse the fields of the ini settings section which nyfikenc uses to global
+// setting.
+func parseClientSettings(global *settings.Prog, config ini.Section) {
+	// Set TCP port number, or path of the Unix socket if no port is set.
+	global.PortNum = config.S(fieldPortNum, "")
+	global.Socket = config.S(fieldSocket, settings.SocketPath)
+
+	// Set authentication of nyfikenc/d communication.
+	global.TokenFile = config.S(fieldTokenFile, "")
+	global.TLS = config.B(fieldTLS, false)
+	global.Fingerprint = config.S(fieldFingerprint, "")
+
+	// Set browser path.
+	global.Browser = config.S(fieldBrowser, "")
+}
+
 // Parse ini settings section to global setting.
-func parseSettings(config ini.Section) (err error) {
+func parseSettings(global *settings.Prog, config ini.Section) (err error) {
 	for fieldName := range config {
 		if _, found := settingsFields[fieldName]; !found {
 			return errutil.NewNoPosf(errFieldNotExist, fieldName)
@@ -147,11 +427,6 @@ func parseSettings(config ini.Section) (err error) {
 	// Get time setting from INI.
 	// If interval setting wasn't found, default value is 1 minute
 	intervalStr := config.S(fieldInterval, settings.DefaultInterval.String())
-	// NOTE: As settings.Global is used several times you could make use of a
-	// local pointer to it, thus making the lines shorted and more readable. I've
-	// included this change in parseSettings and parseMail but if it seems ugly
-	// to you, just revert it.
-	global := &settings.Global
 	// Parse string to duration.
 	global.Interval, err = time.ParseDuration(intervalStr)
 	if err != nil {
@@ -161,17 +436,69 @@ func parseSettings(config ini.Section) (err error) {
 	// Set global file permissions.
 	global.FilePerms = os.FileMode(config.I(fieldFilePerms, int(settings.DefaultFilePerms)))
 
-	// Set port number.
-	global.PortNum = config.S(fieldPortNum, settings.DefaultPortNum)
+	// Set the settings shared with nyfikenc.
+	parseClientSettings(global, config)
 
-	// Set browser path.
-	global.Browser = config.S(fieldBrowser, "")
+	// Set address of the Atom feeds.
+	global.FeedAddr = config.S(fieldFeedAddr, "")
+
+	// Set address of the HTTP API.
+	global.HTTPAddr = config.S(fieldHTTPAddr, "")
+	global.WebUI = config.B(fieldWebUI, false)
+
+	// Set timeout of external strip commands.
+	execTimeoutStr := config.S(fieldExecTimeout, settings.DefaultExecTimeout.String())
+	global.ExecTimeout, err = time.ParseDuration(execTimeoutStr)
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	// Set command to run when a page has been updated.
+	global.OnUpdate = config.S(fieldOnUpdate, "")
+	onUpdateTimeoutStr := config.S(fieldOnUpdateTimeout, settings.DefaultOnUpdateTimeout.String())
+	global.OnUpdateTimeout, err = time.ParseDuration(onUpdateTimeoutStr)
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	// Set whether delivered notifications mark updates as read.
+	global.MarkRead = config.B(fieldMarkRead, false)
+
+	// Set suppression of notifications about flapping pages and the rate limit
+	// of notifications.
+	global.FlapLimit = config.I(fieldFlapLimit, 0)
+	global.RateLimit, global.RateWindow, err = parseRateLimit(config.S(fieldRateLimit, ""))
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	// Set default notification targets.
+	global.Notify = config.List(fieldNotify)
+	if global.Notify == nil {
+		if _, found := config[fieldNotify]; found {
+			return errutil.NewNoPosf(errInvalidListDeclaration)
+		}
+	}
+
+	// Set logging; the maximum size of the log file is given in megabytes.
+	global.LogLevel = config.S(fieldLogLevel, "info")
+	_, err = logging.ParseLevel(global.LogLevel)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	global.LogFormat = strings.ToLower(config.S(fieldLogFormat, logging.FormatText))
+	if global.LogFormat != logging.FormatText && global.LogFormat != logging.FormatJSON {
+		return errutil.NewNoPosf(errInvalidLogFormat, global.LogFormat)
+	}
+	global.LogFile = config.S(fieldLogFile, "")
+	global.LogMaxSize = int64(config.I(fieldLogMaxSize, settings.DefaultLogMaxSize>>20)) << 20
+	global.LogBackups = config.I(fieldLogBackups, settings.DefaultLogBackups)
 
 	return nil
 }
 
 // Parse ini mail section to global setting.
-func parseMail(mail ini.Section) (err error) {
+func parseMail(global *settings.Prog, mail ini.Section) (err error) {
 	for fieldName := range mail {
 		if _, found := mailFields[fieldName]; !found {
 			return errutil.NewNoPosf(errFieldNotExist, fieldName)
@@ -179,7 +506,6 @@ func parseMail(mail ini.Section) (err error) {
 	}
 
 	// Set global sender mail.
-	global := &settings.Global
 	global.SenderMail.Address = mail.S(fieldSendMail, "")
 	if global.SenderMail.Address == "" {
 		return errutil.NewNoPosf(errMailAddressNotFound)
@@ -187,13 +513,11 @@ func parseMail(mail ini.Section) (err error) {
 		return errutil.NewNoPosf(errInvalidMailAddress, global.SenderMail.Address)
 	}
 
-	// Set global sender mail password.
-	global.SenderMail.Password = mail.S(fieldSendPass, "")
-
-	// Set global sender authorization server.
-	global.SenderMail.AuthServer = mail.S(fieldSendAuthServer, "")
-	if global.SenderMail.AuthServer == "" {
-		return errutil.NewNoPosf(errMailAuthServerNotFound)
+	// Set global sender mail password, which may refer to a secret stored
+	// elsewhere.
+	global.SenderMail.Password, err = secret.Resolve(mail.S(fieldSendPass, ""))
+	if err != nil {
+		return errutil.Err(err)
 	}
 
 	// Set global sender mail outgoing server.
@@ -201,20 +525,246 @@ func parseMail(mail ini.Section) (err error) {
 	if global.SenderMail.OutServer == "" {
 		return errutil.NewNoPosf(errMailOutServerNotFound)
 	}
+	host, _, err := net.SplitHostPort(global.SenderMail.OutServer)
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	// Set security mode of the connection to the outgoing server.
+	global.SenderMail.Security = strings.ToLower(mail.S(fieldSecurity, nmail.SecurityStartTLS))
+	switch global.SenderMail.Security {
+	case nmail.SecurityTLS, nmail.SecurityStartTLS, nmail.SecurityNone:
+	default:
+		return errutil.NewNoPosf(errInvalidMailSecurity, global.SenderMail.Security)
+	}
+
+	// Set authentication mechanism.
+	global.SenderMail.Auth = strings.ToLower(mail.S(fieldAuth, nmail.AuthPlain))
+	switch global.SenderMail.Auth {
+	case nmail.AuthNone, nmail.AuthCRAMMD5:
+	case nmail.AuthPlain, nmail.AuthLogin:
+		// These mechanisms send the password in the clear.
+		if global.SenderMail.Security == nmail.SecurityNone && !nmail.IsLocalhost(host) {
+			return errutil.NewNoPosf(errUnencryptedMailAuth, host)
+		}
+	default:
+		return errutil.NewNoPosf(errInvalidMailAuth, global.SenderMail.Auth)
+	}
 
-	// Set global receive mail.
+	// Set global sender authorization server, which is only needed to
+	// authenticate.
+	global.SenderMail.AuthServer = mail.S(fieldSendAuthServer, "")
+	if global.SenderMail.AuthServer == "" && global.SenderMail.Auth != nmail.AuthNone {
+		return errutil.NewNoPosf(errMailAuthServerNotFound)
+	}
+
+	// Set global receive mail, which is required unless notification targets
+	// are defined.
 	global.RecvMail = mail.S(fieldRecvMail, "")
-	if global.RecvMail == "" {
-		return errutil.NewNoPosf(errMailAddressNotFound)
-	} else if !strings.Contains(global.RecvMail, "@") {
+	if global.RecvMail != "" && !strings.Contains(global.RecvMail, "@") {
 		return errutil.NewNoPosf(errInvalidMailAddress, global.RecvMail)
 	}
 
+	// Set templates of notification mails and make sure they parse.
+	format := &global.MailFormat
+	format.Subject = mail.S(fieldSubject, "")
+	format.Text = mail.S(fieldTextTemplate, "")
+	format.HTML = mail.S(fieldHTMLTemplate, "")
+	_, err = nmail.LoadTemplates(format.Subject, format.Text, format.HTML)
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	// Set whether to attach the full snapshot of the page.
+	format.Attach = mail.B(fieldAttach, false)
+
+	// Set default schedule of digest mails.
+	global.Digest.Default = mail.S(fieldDigest, digest.Immediate)
+	_, err = digest.ParseSchedule(global.Digest.Default)
+	if err != nil {
+		return errutil.Err(err)
+	}
+
 	return nil
 }
 
-// ReadPages reads pages file and returns a slice of pages.
+// Parse ini digest section, which maps recipient mail addresses to digest
+// schedules, to global setting.
+func parseDigest(global *settings.Prog, section ini.Section) (err error) {
+	recipients := make(map[string]string)
+	for recipient := range section {
+		if !strings.Contains(recipient, "@") {
+			return errutil.NewNoPosf(errInvalidMailAddress, recipient)
+		}
+		recipients[recipient] = section.S(recipient, "")
+		_, err = digest.ParseSchedule(recipients[recipient])
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+	global.Digest.Recipients = recipients
+	return nil
+}
+
+// Parse ini webhook section to global setting.
+func parseWebhook(global *settings.Prog, webhook ini.Section) (err error) {
+	for fieldName := range webhook {
+		if _, found := webhookFields[fieldName]; !found {
+			return errutil.NewNoPosf(errFieldNotExist, fieldName)
+		}
+	}
+
+	// Set global webhook URL.
+	global.Webhook.URL, err = secret.Resolve(webhook.S(fieldURL, ""))
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if global.Webhook.URL == "" {
+		return errutil.NewNoPosf(errWebhookURLNotFound)
+	}
+	if !isValidWebhook(global.Webhook.URL) {
+		return errutil.NewNoPosf(errInvalidWebhookURL, global.Webhook.URL)
+	}
+
+	// Set path to the payload template, which is parsed once here.
+	global.Webhook.Template = webhook.S(fieldTemplate, "")
+	if global.Webhook.Template != "" {
+		global.Webhook.Payload, err = notify.ParseTemplate(global.Webhook.Template)
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+
+	// Set number of retries of failed deliveries.
+	global.Webhook.Retries = webhook.I(fieldRetries, notify.DefaultRetries)
+
+	return nil
+}
+
+// Parse a list of `Name: Value` headers into m, where the values are references
+// to secrets if isSecret is set.
+func parseHeaders(m map[string]string, headers []string, isSecret bool) (err error) {
+	for _, header := range headers {
+		keyVal := strings.SplitN(header, ":", 2)
+		if len(keyVal) != 2 {
+			return errutil.NewNoPosf(errInvalidHeader, header)
+		}
+		value := strings.TrimSpace(keyVal[1])
+		if isSecret {
+			if !secret.IsRef(value) {
+				return errutil.NewNoPosf(errInvalidSecretHeader, header)
+			}
+			value, err = secret.Resolve(value)
+			if err != nil {
+				return errutil.Err(err)
+			}
+		}
+		m[strings.TrimSpace(keyVal[0])] = value
+	}
+	return nil
+}
+
+// Parse ini notification target section ([notify name]).
+func parseTarget(global *settings.Prog, name string, section ini.Section) (t settings.Target, err error) {
+	for fieldName := range section {
+		if _, found := targetFields[fieldName]; !found {
+			return t, errutil.NewNoPosf(errFieldNotExist, fieldName)
+		}
+	}
+
+	t.Type = section.S(fieldType, "")
+	switch t.Type {
+	case settings.TargetMail:
+		if global.SenderMail.Address == "" {
+			return t, errutil.NewNoPosf(errTargetMailNoSender, name)
+		}
+		t.To = section.List(fieldTo)
+		if t.To == nil {
+			if _, found := section[fieldTo]; found {
+				return t, errutil.NewNoPosf(errInvalidListDeclaration)
+			}
+		}
+		if len(t.To) == 0 {
+			return t, errutil.NewNoPosf(errTargetFieldNotFound, name, fieldTo)
+		}
+		for _, to := range t.To {
+			if !strings.Contains(to, "@") {
+				return t, errutil.NewNoPosf(errInvalidMailAddress, to)
+			}
+		}
+	case settings.TargetWebhook:
+		t.URL, err = secret.Resolve(section.S(fieldURL, ""))
+		if err != nil {
+			return t, errutil.Err(err)
+		}
+		if t.URL == "" {
+			return t, errutil.NewNoPosf(errTargetFieldNotFound, name, fieldURL)
+		}
+		if !isValidWebhook(t.URL) {
+			return t, errutil.NewNoPosf(errInvalidWebhookURL, t.URL)
+		}
+		t.Template = section.S(fieldTemplate, "")
+		if t.Template != "" {
+			t.Payload, err = notify.ParseTemplate(t.Template)
+			if err != nil {
+				return t, errutil.Err(err)
+			}
+		}
+		t.Retries = section.I(fieldRetries, notify.DefaultRetries)
+	case settings.TargetCommand:
+		t.Command = section.S(fieldCommand, "")
+		if t.Command == "" {
+			return t, errutil.NewNoPosf(errTargetFieldNotFound, name, fieldCommand)
+		}
+		t.Timeout, err = time.ParseDuration(section.S(fieldTimeout, global.OnUpdateTimeout.String()))
+		if err != nil {
+			return t, errutil.Err(err)
+		}
+	default:
+		return t, errutil.NewNoPosf(errInvalidTargetType, t.Type)
+	}
+	return t, nil
+}
+
+// parseRateLimit parses a rate limit of notifications, e.g. "3/1h". An empty
+// string is no limit.
+func parseRateLimit(s string) (rate int, window time.Duration, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	pos := strings.Index(s, "/")
+	if pos == -1 {
+		return 0, 0, errutil.NewNoPosf(errInvalidRateLimit, s)
+	}
+	rate, err = strconv.Atoi(strings.TrimSpace(s[:pos]))
+	if err != nil || rate < 1 {
+		return 0, 0, errutil.NewNoPosf(errInvalidRateLimit, s)
+	}
+	window, err = time.ParseDuration(strings.TrimSpace(s[pos+1:]))
+	if err != nil || window <= 0 {
+		return 0, 0, errutil.NewNoPosf(errInvalidRateLimit, s)
+	}
+	return rate, window, nil
+}
+
+// isValidWebhook reports whether rawurl is an absolute HTTP(S) URL.
+func isValidWebhook(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// ReadPages reads pages file and returns a slice of pages, which use the global
+// settings unless overwritten by site-specific settings.
 func ReadPages(pagesPath string) (pages []*page.Page, err error) {
+	return ParsePages(pagesPath, settings.Global())
+}
+
+// ParsePages reads pages file and returns a slice of pages, which use the
+// settings of global unless overwritten by site-specific settings.
+func ParsePages(pagesPath string, global *settings.Prog) (pages []*page.Page, err error) {
 
 	// Parse pages file.
 	file := ini.New()
@@ -230,9 +780,7 @@ func ReadPages(pagesPath string) (pages []*page.Page, err error) {
 			continue
 		}
 
-		if settings.Verbose {
-			fmt.Println("[o] Watching:", name)
-		}
+		slog.Debug("watching", "page", name)
 
 		for fieldName := range section {
 			if _, found := siteFields[fieldName]; !found {
@@ -249,21 +797,30 @@ func ReadPages(pagesPath string) (pages []*page.Page, err error) {
 			return nil, errutil.Err(err)
 		}
 
+		// Set name used in notifications.
+		pageSettings.Name = section.S(fieldName, "")
+
 		// Set CSS selector.
 		pageSettings.Selection = section.S(fieldSelection, "")
 
-		// Set regular expression string.
-		pageSettings.Regexp = section.S(fieldRegexp, "")
+		// Set regular expressions.
+		pageSettings.Regexps, err = parseExprs(section, fieldRegexp)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
 
-		// Set "negexp" (negative regular expression) string which removes all
-		// that matches it.
-		pageSettings.Negexp = section.S(fieldNegexp, "")
+		// Set "negexp" (negative regular expression) which removes all that
+		// matches it, or replaces it with a template.
+		pageSettings.Negexps, err = parseExprs(section, fieldNegexp)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
 
 		// Set threshold value.
 		pageSettings.Threshold = section.F64(fieldThreshold, 0)
 
 		// Set interval time.
-		intervalStr := section.S(fieldInterval, settings.Global.Interval.String())
+		intervalStr := section.S(fieldInterval, global.Interval.String())
 		// Parse string to duration.
 		pageSettings.Interval, err = time.ParseDuration(intervalStr)
 		if err != nil {
@@ -271,22 +828,72 @@ func ReadPages(pagesPath string) (pages []*page.Page, err error) {
 		}
 
 		// Set individual mail address.
-		pageSettings.RecvMail = section.S(fieldRecvMail, settings.Global.RecvMail)
+		pageSettings.RecvMail = section.S(fieldRecvMail, global.RecvMail)
 		if pageSettings.RecvMail != "" && !strings.Contains(pageSettings.RecvMail, "@") {
 			return nil, errutil.NewNoPosf(errInvalidMailAddress, pageSettings.RecvMail)
 		}
 
-		// Set individual header.
-		headers := section.List(fieldHeader)
-		m := make(map[string]string)
-		for _, header := range headers {
-			if strings.Contains(header, ":") {
-				keyVal := strings.SplitN(header, ":", 2)
-				m[strings.TrimSpace(keyVal[0])] = strings.TrimSpace(keyVal[1])
-			} else {
-				return nil, errutil.NewNoPosf(errInvalidHeader, header)
+		// Set individual webhook. A secret webhook refers to a URL stored
+		// elsewhere, while a webhook is always a literal URL.
+		pageSettings.Webhook = section.S(fieldWebhook, global.Webhook.URL)
+		if ref := section.S(fieldSecretWebhook, ""); ref != "" {
+			if !secret.IsRef(ref) {
+				return nil, errutil.NewNoPosf(errInvalidSecretWebhook, ref)
+			}
+			pageSettings.Webhook, err = secret.Resolve(ref)
+			if err != nil {
+				return nil, errutil.Err(err)
+			}
+			if !isValidWebhook(pageSettings.Webhook) {
+				return nil, errutil.NewNoPosf(errInvalidWebhookURL, ref)
+			}
+		}
+		if pageSettings.Webhook != "" && !isValidWebhook(pageSettings.Webhook) {
+			return nil, errutil.NewNoPosf(errInvalidWebhookURL, pageSettings.Webhook)
+		}
+
+		// Set individual command to run on updates.
+		pageSettings.OnUpdate = section.S(fieldOnUpdate, global.OnUpdate)
+
+		// Set individual notification targets.
+		pageSettings.Notify = section.List(fieldNotify)
+		if pageSettings.Notify == nil {
+			if _, found := section[fieldNotify]; found {
+				return nil, errutil.NewNoPosf(errInvalidListDeclaration)
+			}
+			pageSettings.Notify = global.Notify
+		}
+		for _, name := range pageSettings.Notify {
+			if _, found := global.Targets[name]; !found {
+				return nil, errutil.NewNoPosf(errUnknownTarget, name, name)
 			}
 		}
+
+		// Set individual suppression of notifications.
+		pageSettings.FlapLimit = section.I(fieldFlapLimit, global.FlapLimit)
+		pageSettings.RateLimit, pageSettings.RateWindow = global.RateLimit, global.RateWindow
+		if rate := section.S(fieldRateLimit, ""); rate != "" {
+			pageSettings.RateLimit, pageSettings.RateWindow, err = parseRateLimit(rate)
+			if err != nil {
+				return nil, errutil.Err(err)
+			}
+		}
+
+		// Set individual whether delivered notifications mark updates as read.
+		pageSettings.MarkRead = section.B(fieldMarkRead, global.MarkRead)
+
+		// Set individual header. Values of secret headers, e.g. session
+		// cookies, refer to secrets stored elsewhere, while values of other
+		// headers are always literal.
+		m := make(map[string]string)
+		err = parseHeaders(m, section.List(fieldHeader), false)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		err = parseHeaders(m, section.List(fieldSecretHeader), true)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
 		pageSettings.Header = m
 
 		// Set strip functions to use.
@@ -297,10 +904,52 @@ func ReadPages(pagesPath string) (pages []*page.Page, err error) {
 			}
 		}
 		for _, stripFunc := range pageSettings.StripFuncs {
-			if _, found := stripFunctions[stripFunc]; !found {
+			if _, err := strip.Lookup(stripFunc); err != nil {
 				return nil, errutil.NewNoPosf(errInvalidStripFunction, stripFunc)
 			}
 		}
+
+		// Set CSS selectors of subtrees to remove before comparison.
+		pageSettings.Exclude = section.List(fieldExclude)
+		if pageSettings.Exclude == nil {
+			if _, found := section[fieldExclude]; found {
+				return nil, errutil.NewNoPosf(errInvalidListDeclaration)
+			}
+		}
+		for _, sel := range pageSettings.Exclude {
+			if _, err := cascadia.Compile(sel); err != nil {
+				return nil, errutil.NewNoPosf(errInvalidSelector, sel, err)
+			}
+		}
+
+		// Set tags of the page.
+		pageSettings.Tags = section.List(fieldTag)
+		if pageSettings.Tags == nil {
+			if _, found := section[fieldTag]; found {
+				return nil, errutil.NewNoPosf(errInvalidListDeclaration)
+			}
+		}
+
+		// Set extraction mode of the selection.
+		pageSettings.Extract = section.S(fieldExtract, "")
+		if !isValidExtract(pageSettings.Extract) {
+			return nil, errutil.NewNoPosf(errInvalidExtract, pageSettings.Extract)
+		}
+
+		// Set named fields to extract.
+		fields := section.List(fieldField)
+		if fields == nil {
+			if _, found := section[fieldField]; found {
+				return nil, errutil.NewNoPosf(errInvalidListDeclaration)
+			}
+		}
+		for _, field := range fields {
+			f, err := parseField(field)
+			if err != nil {
+				return nil, errutil.Err(err)
+			}
+			pageSettings.Fields = append(pageSettings.Fields, f)
+		}
 		p.Settings = pageSettings
 
 		pages = append(pages, &p)
@@ -311,3 +960,74 @@ func ReadPages(pagesPath string) (pages []*page.Page, err error) {
 	}
 	return pages, nil
 }
+
+// exprSep separates the regular expression from the replacement template in
+// regexp and negexp values, e.g. `Price: (?P<price>[\d ]+) kr => ${price}`.
+const exprSep = " => "
+
+// parseExprs parses the regular expression steps of the provided field. The
+// field may either be a single value (`=`) or a list (`<`).
+func parseExprs(section ini.Section, fieldName string) (exprs []settings.Expr, err error) {
+	values := section.List(fieldName)
+	if values == nil {
+		if value := section.S(fieldName, ""); value != "" {
+			values = []string{value}
+		}
+	}
+
+	for _, value := range values {
+		var expr settings.Expr
+		if i := strings.LastIndex(value, exprSep); i != -1 {
+			expr.Pattern = value[:i]
+			expr.Template = strings.TrimSpace(value[i+len(exprSep):])
+		} else {
+			expr.Pattern = value
+		}
+		if _, err := regexp.Compile(expr.Pattern); err != nil {
+			return nil, errutil.NewNoPosf(errInvalidRegexp, expr.Pattern, err)
+		}
+		exprs = append(exprs, expr)
+	}
+	return exprs, nil
+}
+
+// isValidExtract reports whether mode is a valid extraction mode. The empty
+// string is valid and renders HTML.
+func isValidExtract(mode string) bool {
+	switch {
+	case mode == "", mode == settings.ExtractHTML, mode == settings.ExtractText:
+		return true
+	case strings.HasPrefix(mode, settings.ExtractAttrPrefix):
+		return len(mode) > len(settings.ExtractAttrPrefix)
+	}
+	return false
+}
+
+// fieldSep separates the CSS selector from the extraction mode in field
+// values. The surrounding spaces are required, as `|` may be part of a selector.
+const fieldSep = " | "
+
+// parseField parses a named field value, e.g. `download: a.download | attr:href`.
+// The extraction mode is optional.
+func parseField(value string) (field settings.Field, err error) {
+	keyVal := strings.SplitN(value, ":", 2)
+	if len(keyVal) != 2 {
+		return field, errutil.NewNoPosf(errInvalidField, value)
+	}
+	field.Name = strings.TrimSpace(keyVal[0])
+	field.Selection = strings.TrimSpace(keyVal[1])
+	if i := strings.LastIndex(field.Selection, fieldSep); i != -1 {
+		field.Extract = strings.TrimSpace(field.Selection[i+len(fieldSep):])
+		field.Selection = strings.TrimSpace(field.Selection[:i])
+	}
+	if field.Name == "" || field.Selection == "" {
+		return field, errutil.NewNoPosf(errInvalidField, value)
+	}
+	if _, err := cascadia.Compile(field.Selection); err != nil {
+		return field, errutil.NewNoPosf(errInvalidSelector, field.Selection, err)
+	}
+	if !isValidExtract(field.Extract) {
+		return field, errutil.NewNoPosf(errInvalidExtract, field.Extract)
+	}
+	return field, nil
+}
@@ -1,10 +1,14 @@
 package ini
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/karlek/nyfiken/page"
@@ -19,18 +23,93 @@ func TestReadSettings(t *testing.T) {
 		RecvMail:  "global@example.com",
 		FilePerms: os.FileMode(0777),
 		PortNum:   ":4113",
+		Socket:    settings.SocketPath,
 		Browser:   "/usr/bin/browser",
+		FeedAddr:  "localhost:5240",
+		HTTPAddr:  "localhost:5241",
+		WebUI:     true,
+
+		TokenFile:   "/home/user/.config/nyfiken/token",
+		TLS:         true,
+		Fingerprint: "0123456789abcdef",
+
+		ExecTimeout: 5 * time.Second,
+
+		OnUpdate:        "/usr/bin/true",
+		OnUpdateTimeout: 30 * time.Second,
+
+		MarkRead: true,
+
+		FlapLimit:  4,
+		RateLimit:  3,
+		RateWindow: time.Hour,
+
+		LogLevel:   "warn",
+		LogFormat:  "json",
+		LogFile:    "/var/log/nyfiken.log",
+		LogMaxSize: 5 << 20,
+		LogBackups: 2,
+
+		Notify: []string{"team"},
+		Targets: map[string]settings.Target{
+			"team": {
+				Type: settings.TargetMail,
+				To:   []string{"alice@example.com", "bob@example.com"},
+			},
+			"chat": {
+				Type:    settings.TargetWebhook,
+				URL:     "https://chat.example.com/hooks/team",
+				Retries: 2,
+			},
+			"archive": {
+				Type:    settings.TargetCommand,
+				Command: "/usr/bin/archive-page",
+				Timeout: 2 * time.Minute,
+			},
+		},
 
 		SenderMail: struct {
 			Address    string
 			Password   string
 			AuthServer string
 			OutServer  string
+			Security   string
+			Auth       string
 		}{
 			Address:    "sender@example.com",
 			Password:   "123456",
 			AuthServer: "auth.server.com",
 			OutServer:  "out.server.com:587",
+			Security:   "starttls",
+			Auth:       "login",
+		},
+
+		MailFormat: struct {
+			Subject string
+			Text    string
+			HTML    string
+			Attach  bool
+		}{
+			Subject: "{{.Name}} has been updated",
+			Attach:  true,
+		},
+
+		Digest: struct {
+			Default    string
+			Recipients map[string]string
+		}{
+			Default:    "hourly",
+			Recipients: map[string]string{"team@example.com": "daily@08:30"},
+		},
+
+		Webhook: struct {
+			URL      string
+			Template string
+			Payload  *template.Template
+			Retries  int
+		}{
+			URL:     "https://chat.example.com/hooks/nyfiken",
+			Retries: 5,
 		},
 	}
 
@@ -41,8 +120,8 @@ func TestReadSettings(t *testing.T) {
 
 	// NOTE: As you already pointed out the fmt solution was ugly although
 	// creative. reflect.DeepEqual can be used instead.
-	if !reflect.DeepEqual(settings.Global, expected) {
-		t.Errorf("output %v != %v", settings.Global, expected)
+	if !reflect.DeepEqual(*settings.Global(), expected) {
+		t.Errorf("output %v != %v", *settings.Global(), expected)
 	}
 }
 
@@ -61,28 +140,68 @@ func TestReadPages(t *testing.T) {
 		{
 			ReqUrl: reqUrl,
 			Settings: settings.Page{
-				Interval:  3 * time.Minute,
-				Threshold: 0.05,
-				RecvMail:  "mail@example.org",
+				Name:       "Example",
+				Interval:   3 * time.Minute,
+				Threshold:  0.05,
+				RecvMail:   "mail@example.org",
+				Webhook:    "https://chat.example.com/hooks/example",
+				OnUpdate:   "make -C /home/user/mirror",
+				Notify:     []string{"chat", "archive"},
+				FlapLimit:  4,
+				RateLimit:  10,
+				RateWindow: 24 * time.Hour,
+				Tags: []string{
+					"news",
+					"work",
+				},
 				Selection: "html body",
 				StripFuncs: []string{
 					"html",
 					"numbers",
 				},
-				Regexp: "(love)",
-				Negexp: "(hate)",
+				Regexps: []settings.Expr{
+					{Pattern: "(love)"},
+				},
+				Negexps: []settings.Expr{
+					{Pattern: "(hate)"},
+				},
+				Exclude: []string{
+					".related-articles",
+					"#ad-slot",
+				},
 				Header: map[string]string{
-					"Cookie":     "IloveCookies=1;",
-					"User-Agent": "I come in peace",
+					"Cookie":        "IloveCookies=1;",
+					"User-Agent":    "I come in peace",
+					"X-Literal":     "cmd:not a secret",
+					"Authorization": "Bearer 123456",
 				},
 			},
 		},
 		{
 			ReqUrl: anotherReqUrl,
 			Settings: settings.Page{
-				Interval:  settings.Global.Interval,
-				RecvMail:  settings.Global.RecvMail,
-				Selection: "#main-content",
+				Interval:   settings.Global().Interval,
+				RecvMail:   settings.Global().RecvMail,
+				Webhook:    settings.Global().Webhook.URL,
+				OnUpdate:   settings.Global().OnUpdate,
+				Notify:     settings.Global().Notify,
+				FlapLimit:  settings.Global().FlapLimit,
+				RateLimit:  settings.Global().RateLimit,
+				RateWindow: settings.Global().RateWindow,
+				MarkRead:   settings.Global().MarkRead,
+				Selection:  "#main-content",
+				Extract:    "text",
+				Fields: []settings.Field{
+					{Name: "download", Selection: "a.download", Extract: "attr:href"},
+					{Name: "title", Selection: "h1"},
+				},
+				Regexps: []settings.Expr{
+					{Pattern: `Price: (?P<price>[\d ]+) kr`, Template: "${price}"},
+				},
+				Negexps: []settings.Expr{
+					{Pattern: `(\d) (\d)`, Template: "$1$2"},
+					{Pattern: `kr`},
+				},
 				// NOTE: Added since reflect.DeepEqual differentiates between nil
 				// maps and empty (but initialized) maps.
 				Header: map[string]string{},
@@ -90,6 +209,8 @@ func TestReadPages(t *testing.T) {
 		},
 	}
 
+	os.Setenv("NYFIKEN_TEST_AUTH", "Bearer 123456")
+	defer os.Unsetenv("NYFIKEN_TEST_AUTH")
 	pages, err := ReadPages("ini_test_pages.ini")
 	if err != nil {
 		t.Fatal("ReadPages:", err)
@@ -99,3 +220,181 @@ func TestReadPages(t *testing.T) {
 		t.Fatalf("pages differ: expected %#v, got %#v", expected, pages)
 	}
 }
+
+// Tests CheckSecrets
+func TestCheckSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-ini")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	golden := []struct {
+		config  string
+		pages   string
+		perm    os.FileMode
+		wantErr bool
+	}{
+		// i=0
+		{config: "[mail]\nsendpass = 123456\n", perm: 0600},
+		// i=1
+		{config: "[mail]\nsendpass = 123456\n", perm: 0644, wantErr: true},
+		// i=2
+		{config: "[mail]\nsendpass = env:NYFIKEN_PASS\n", perm: 0644},
+		// i=3
+		{config: "[mail]\nsendpass = cmd:pass show nyfiken\n", perm: 0644},
+		// i=4
+		{config: "[mail]\nsendpass =\n", perm: 0644},
+		// i=5
+		{config: "[webhook]\nurl = https://chat.example.com/hooks/secret\n", perm: 0644, wantErr: true},
+		// i=6
+		{config: "[webhook]\nurl = env:NYFIKEN_WEBHOOK\n", perm: 0644},
+		// i=7
+		{config: "[notify chat]\ntype = webhook\nurl = https://chat.example.com/hooks/secret\n", perm: 0644, wantErr: true},
+		// i=8
+		{pages: "[http://example.org]\nwebhook = https://chat.example.com/hooks/secret\n", perm: 0644, wantErr: true},
+		// i=9
+		{pages: "[http://example.org]\nheader < Cookie: session=secret\n", perm: 0644, wantErr: true},
+		// i=10
+		{pages: "[http://example.org]\nheader < User-Agent: nyfiken\nsecretheader < Cookie: env:NYFIKEN_COOKIE\n", perm: 0644},
+		// i=11
+		{pages: "[http://example.org]\nheader < Cookie: session=secret\n", perm: 0600},
+	}
+
+	for i, g := range golden {
+		configPath := filepath.Join(dir, fmt.Sprintf("config%d.ini", i))
+		pagesPath := filepath.Join(dir, fmt.Sprintf("pages%d.ini", i))
+		for path, content := range map[string]string{configPath: g.config, pagesPath: g.pages} {
+			err = ioutil.WriteFile(path, []byte(content), g.perm)
+			if err != nil {
+				t.Fatal("ioutil.WriteFile:", err)
+			}
+			// Ignore the umask.
+			err = os.Chmod(path, g.perm)
+			if err != nil {
+				t.Fatal("os.Chmod:", err)
+			}
+		}
+		err = CheckSecrets(configPath, pagesPath)
+		if g.wantErr && err == nil {
+			t.Errorf("i=%d: expected error, got nil", i)
+		} else if !g.wantErr && err != nil {
+			t.Errorf("i=%d: CheckSecrets: %v", i, err)
+		}
+	}
+}
+
+func TestRecvMailOptional(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-ini")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	defer settings.SetGlobal(settings.Global())
+
+	const mail = "[mail]\nsendmail = sender@example.com\nsendoutserver = out.server.com:587\nauth = none\n"
+	golden := []struct {
+		config  string
+		wantErr bool
+	}{
+		// i=0
+		{config: mail + "recvmail = global@example.com\n"},
+		// i=1
+		{config: mail, wantErr: true},
+		// i=2
+		{config: mail + "[notify team]\ntype = mail\nto < alice@example.com\n"},
+		// i=3
+		{config: mail + "recvmail = global\n", wantErr: true},
+	}
+
+	for i, g := range golden {
+		path := filepath.Join(dir, fmt.Sprintf("config%d.ini", i))
+		err = ioutil.WriteFile(path, []byte(g.config), 0600)
+		if err != nil {
+			t.Fatal("ioutil.WriteFile:", err)
+		}
+		err = ReadSettings(path)
+		if g.wantErr && err == nil {
+			t.Errorf("i=%d: expected error, got nil", i)
+		} else if !g.wantErr && err != nil {
+			t.Errorf("i=%d: ReadSettings: %v", i, err)
+		}
+	}
+}
+
+func TestReadClientSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-ini")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	defer settings.SetGlobal(settings.Global())
+
+	// The password command isn't run and the invalid mail section is ignored.
+	marker := filepath.Join(dir, "ran")
+	config := "[settings]\nportnum = :5239\ntls = true\nfingerprint = ab:cd\ntokenfile = /tmp/token\nbrowser = firefox\n" +
+		"[mail]\nsendpass = cmd:touch " + marker + "\nsecurity = carrier pigeon\n"
+	path := filepath.Join(dir, "config.ini")
+	err = ioutil.WriteFile(path, []byte(config), 0600)
+	if err != nil {
+		t.Fatal("ioutil.WriteFile:", err)
+	}
+	err = ReadClientSettings(path)
+	if err != nil {
+		t.Fatal("ReadClientSettings:", err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("expected the password command to not run")
+	}
+	g := settings.Global()
+	if g.PortNum != ":5239" || !g.TLS || g.Fingerprint != "ab:cd" || g.TokenFile != "/tmp/token" || g.Browser != "firefox" {
+		t.Errorf("unexpected client settings %+v", g)
+	}
+}
+
+func TestSecretWebhook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-ini")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("NYFIKEN_TEST_WEBHOOK", "https://chat.example.com/hooks/secret")
+	defer os.Unsetenv("NYFIKEN_TEST_WEBHOOK")
+
+	golden := []struct {
+		page    string
+		want    string
+		wantErr bool
+	}{
+		// i=0
+		{page: "webhook = https://chat.example.com/hooks/a\n", want: "https://chat.example.com/hooks/a"},
+		// i=1
+		{page: "secretwebhook = env:NYFIKEN_TEST_WEBHOOK\n", want: "https://chat.example.com/hooks/secret"},
+		// i=2
+		{page: "webhook = env:NYFIKEN_TEST_WEBHOOK\n", wantErr: true},
+		// i=3
+		{page: "secretwebhook = https://chat.example.com/hooks/a\n", wantErr: true},
+	}
+
+	for i, g := range golden {
+		path := filepath.Join(dir, fmt.Sprintf("pages%d.ini", i))
+		err = ioutil.WriteFile(path, []byte("[http://example.org]\n"+g.page), 0600)
+		if err != nil {
+			t.Fatal("ioutil.WriteFile:", err)
+		}
+		pages, err := ParsePages(path, settings.Defaults())
+		if g.wantErr {
+			if err == nil {
+				t.Errorf("i=%d: expected error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("i=%d: ParsePages: %v", i, err)
+			continue
+		}
+		if got := pages[0].Settings.Webhook; got != g.want {
+			t.Errorf("i=%d: webhook %q != expected %q", i, got, g.want)
+		}
+	}
+}
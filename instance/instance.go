@@ -0,0 +1,104 @@
+// Package instance ensures that only one nyfikend runs per nyfiken folder, with
+// an advisory lock file and a pid file in the nyfiken folder.
+package instance
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// lockFile is the held lock file, which is released on Unlock or when the
+// process exits.
+var lockFile *os.File
+
+// errLocked is returned by openLock when another process holds the lock.
+var errLocked = errutil.NewNoPos("instance: locked by another process")
+
+// Lock locks the lock file and writes the pid of the process to the pid file.
+// It fails with an error which names the running instance if another nyfikend
+// holds the lock.
+func Lock() (err error) {
+	f, err := openLock(settings.LockPath)
+	if err == errLocked {
+		pid, perr := Running()
+		if perr != nil {
+			return errutil.NewNoPosf("instance: nyfikend is already running with the nyfiken folder `%s`", settings.NyfikenRoot)
+		}
+		return errutil.NewNoPosf("instance: nyfikend is already running with pid %d; stop it with `nyfikend -stop`", pid)
+	}
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	pid := strconv.Itoa(os.Getpid()) + "\n"
+	err = ioutil.WriteFile(settings.PidPath, []byte(pid), settings.DefaultFilePerms)
+	if err != nil {
+		f.Close()
+		return errutil.Err(err)
+	}
+	lockFile = f
+	return nil
+}
+
+// Unlock removes the pid file and releases the lock.
+func Unlock() (err error) {
+	if lockFile == nil {
+		return nil
+	}
+	err = os.Remove(settings.PidPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errutil.Err(err)
+	}
+	err = lockFile.Close()
+	lockFile = nil
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// Running returns the pid of the running nyfikend from the pid file.
+func Running() (pid int, err error) {
+	buf, err := ioutil.ReadFile(settings.PidPath)
+	if err != nil {
+		return 0, errutil.Err(err)
+	}
+	pid, err = strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return 0, errutil.NewNoPosf("instance: invalid pid file `%s`", settings.PidPath)
+	}
+	return pid, nil
+}
+
+// Stop signals the running nyfikend to stop, and returns its pid. On Windows
+// the process is killed instead of stopped gracefully.
+func Stop() (pid int, err error) {
+	// If the lock is free, no nyfikend is running.
+	f, err := openLock(settings.LockPath)
+	if err == nil {
+		f.Close()
+		return 0, errutil.NewNoPosf("instance: nyfikend isn't running with the nyfiken folder `%s`", settings.NyfikenRoot)
+	}
+	if err != errLocked {
+		return 0, errutil.Err(err)
+	}
+
+	pid, err = Running()
+	if err != nil {
+		return 0, errutil.Err(err)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, errutil.Err(err)
+	}
+	err = signalStop(p)
+	if err != nil {
+		return 0, errutil.Err(err)
+	}
+	return pid, nil
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package instance
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// openLock opens the lock file at path and takes an exclusive advisory lock on
+// it, without waiting for other processes to release it.
+func openLock(path string) (f *os.File, err error) {
+	f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+		return nil, errutil.Err(err)
+	}
+	return f, nil
+}
+
+// signalStop makes the process stop gracefully.
+func signalStop(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
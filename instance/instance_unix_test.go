@@ -0,0 +1,68 @@
+//go:build unix
+
+package instance
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/karlek/nyfiken/settings"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-instance")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.NyfikenRoot = dir
+	settings.LockPath = filepath.Join(dir, "nyfikend.lock")
+	settings.PidPath = filepath.Join(dir, "nyfikend.pid")
+
+	// Nothing is running yet.
+	if _, err := Stop(); err == nil {
+		t.Error("Stop: expected error, got nil")
+	}
+
+	err = Lock()
+	if err != nil {
+		t.Fatal("Lock:", err)
+	}
+	pid, err := Running()
+	if err != nil {
+		t.Fatal("Running:", err)
+	}
+	if pid != os.Getpid() {
+		t.Errorf("expected pid %d, got %d", os.Getpid(), pid)
+	}
+
+	// The lock is held, so a second instance is refused with the pid of the
+	// first.
+	first := lockFile
+	lockFile = nil
+	err = Lock()
+	lockFile = first
+	if err == nil {
+		t.Fatal("Lock: expected error, got nil")
+	}
+	if !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Errorf("expected error to name pid %d, got %q", os.Getpid(), err)
+	}
+
+	err = Unlock()
+	if err != nil {
+		t.Fatal("Unlock:", err)
+	}
+	if _, err := os.Stat(settings.PidPath); !os.IsNotExist(err) {
+		t.Error("expected pid file to be removed")
+	}
+	err = Lock()
+	if err != nil {
+		t.Fatal("Lock after Unlock:", err)
+	}
+	Unlock()
+}
@@ -0,0 +1,35 @@
+package instance
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// errSharingViolation is ERROR_SHARING_VIOLATION, which syscall doesn't
+// define.
+const errSharingViolation = syscall.Errno(32)
+
+// openLock opens the lock file at path without sharing it, so other processes
+// can't open it until it's closed.
+func openLock(path string) (f *os.File, err error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if err == errSharingViolation {
+			return nil, errLocked
+		}
+		return nil, errutil.Err(err)
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+// signalStop makes the process stop. Windows has no SIGTERM, so the process is
+// killed without waiting for running checks or saving the updates.
+func signalStop(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,209 @@
+// Package logging configures the levelled, structured logging of nyfikend.
+//
+// Log records are written with log/slog, as text or JSON, to standard error or
+// to a log file which is rotated when it grows too large.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Output formats of log records.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config specifies the logging.
+type Config struct {
+	Level   string // Minimum level of logged records; debug, info, warn or error.
+	Format  string // Format of log records; text or json.
+	File    string // Path of the log file; empty to log to standard error.
+	MaxSize int64  // Size in bytes at which the log file is rotated; 0 to never rotate.
+	Backups int    // Number of rotated log files to keep.
+}
+
+// out is the current log file, which is closed when logging is reconfigured.
+var (
+	mu  sync.Mutex
+	out io.Closer
+)
+
+// Setup configures the default logger, which the log package also writes to.
+func Setup(c Config) (err error) {
+	level, err := ParseLevel(c.Level)
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var w io.Writer = os.Stderr
+	var f *rotator
+	if c.File != "" {
+		f, err = openRotator(c.File, c.MaxSize, c.Backups)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		w = f
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch strings.ToLower(c.Format) {
+	case "", FormatText:
+		h = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		if f != nil {
+			f.Close()
+		}
+		return errutil.NewNoPosf("logging: invalid format `%s`; correct syntax -> `text` or `json`", c.Format)
+	}
+	slog.SetDefault(slog.New(h))
+
+	if out != nil {
+		out.Close()
+		out = nil
+	}
+	if f != nil {
+		out = f
+	}
+	return nil
+}
+
+// ParseLevel parses a log level; debug, info, warn or error. An empty level is
+// info.
+func ParseLevel(s string) (level slog.Level, err error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, errutil.NewNoPosf("logging: invalid level `%s`; correct syntax -> `debug`, `info`, `warn` or `error`", s)
+}
+
+// Fatal logs an error and exits.
+func Fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// rotator is a log file which is renamed to path.1 once it reaches its maximum
+// size, where path.1 is first renamed to path.2 and so on up to the number of
+// backups.
+type rotator struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openRotator opens the log file at path for appending.
+func openRotator(path string, maxSize int64, backups int) (r *rotator, err error) {
+	r = &rotator{path: path, maxSize: maxSize, backups: backups}
+	err = r.open()
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return r, nil
+}
+
+// open opens the log file. The caller must hold r.mu, if r is shared.
+func (r *rotator) open() (err error) {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errutil.Err(err)
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// Write writes a log record, and rotates the log file first if the record
+// would make it exceed its maximum size.
+func (r *rotator) Write(p []byte) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err = r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err = r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the log files and opens a new log file. If the log files
+// can't be renamed, the current log file is opened again so later records are
+// still written. The caller must hold r.mu.
+func (r *rotator) rotate() (err error) {
+	err = r.f.Close()
+	if err == nil {
+		err = r.shift()
+	}
+	openErr := r.open()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if openErr != nil {
+		return errutil.Err(openErr)
+	}
+	return nil
+}
+
+// shift renames the log file to the first backup, and each backup to the next
+// one, or removes the log file if there are no backups.
+func (r *rotator) shift() (err error) {
+	if r.backups > 0 {
+		for i := r.backups - 1; i > 0; i-- {
+			err = os.Rename(backup(r.path, i), backup(r.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return errutil.Err(err)
+			}
+		}
+		err = os.Rename(r.path, backup(r.path, 1))
+	} else {
+		err = os.Remove(r.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// backup returns the path of the ith rotated log file.
+func backup(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Close closes the log file.
+func (r *rotator) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,146 @@
+package logging
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-logging")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	defer slog.SetDefault(slog.Default())
+	path := filepath.Join(dir, "nyfiken.log")
+
+	err = Setup(Config{Level: "info", Format: FormatJSON, File: path})
+	if err != nil {
+		t.Fatal("Setup:", err)
+	}
+	slog.Debug("hidden")
+	slog.With("page", "http://example.org/").Info("updated")
+	log.Print("from the log package")
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("ioutil.ReadFile:", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %d: %q", len(lines), buf)
+	}
+	var rec map[string]interface{}
+	err = json.Unmarshal([]byte(lines[0]), &rec)
+	if err != nil {
+		t.Fatal("json.Unmarshal:", err)
+	}
+	if rec["level"] != "INFO" || rec["msg"] != "updated" || rec["page"] != "http://example.org/" {
+		t.Errorf("unexpected record %v", rec)
+	}
+
+	golden := []Config{
+		{Level: "verbose"},
+		{Format: "xml"},
+		{File: filepath.Join(dir, "missing", "nyfiken.log")},
+	}
+	for i, g := range golden {
+		if err := Setup(g); err == nil {
+			t.Errorf("i=%d: expected error, got nil", i)
+		}
+	}
+}
+
+func TestRotator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-logging")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nyfiken.log")
+
+	r, err := openRotator(path, 10, 2)
+	if err != nil {
+		t.Fatal("openRotator:", err)
+	}
+	defer r.Close()
+	for _, rec := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err = r.Write([]byte(rec))
+		if err != nil {
+			t.Fatal("Write:", err)
+		}
+	}
+
+	// Only the number of backups are kept.
+	want := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for p, content := range want {
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Errorf("ioutil.ReadFile: %v", err)
+			continue
+		}
+		if string(buf) != content {
+			t.Errorf("%s: expected %q, got %q", filepath.Base(p), content, buf)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected %s.3 to not exist", filepath.Base(path))
+	}
+}
+
+func TestRotatorFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-logging")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nyfiken.log")
+
+	// The log file can't be renamed over a directory in place of the backup.
+	err = os.MkdirAll(filepath.Join(path+".1", "dir"), 0755)
+	if err != nil {
+		t.Fatal("os.MkdirAll:", err)
+	}
+
+	r, err := openRotator(path, 10, 1)
+	if err != nil {
+		t.Fatal("openRotator:", err)
+	}
+	defer r.Close()
+	_, err = r.Write([]byte("first\n"))
+	if err != nil {
+		t.Fatal("Write:", err)
+	}
+	_, err = r.Write([]byte("second\n"))
+	if err == nil {
+		t.Error("expected the failed rotation to be reported, got nil")
+	}
+
+	// The current log file stays open, so the rotation is retried on later writes.
+	_, err = r.Write([]byte("third\n"))
+	if err == nil {
+		t.Error("expected the failed rotation to be reported, got nil")
+	}
+	os.RemoveAll(path + ".1")
+	_, err = r.Write([]byte("fourth\n"))
+	if err != nil {
+		t.Fatal("Write:", err)
+	}
+	buf, err := ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal("ioutil.ReadFile:", err)
+	}
+	if string(buf) != "first\n" {
+		t.Errorf("expected %q, got %q", "first\n", buf)
+	}
+}
@@ -0,0 +1,91 @@
+package mail
+
+import (
+	"bytes"
+	htemplate "html/template"
+	ttemplate "text/template"
+	"time"
+
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Templates of digest mails, which are executed with the time of the digest
+// and a list of messages.
+var (
+	digestSubject = ttemplate.Must(ttemplate.New("subject").Parse(
+		`[ nyfiken ] {{len .Messages}} updated page{{if gt (len .Messages) 1}}s{{end}}`))
+
+	digestText = ttemplate.Must(ttemplate.New("text").Parse(
+		`{{len .Messages}} page{{if gt (len .Messages) 1}}s have{{else}} has{{end}} been updated :)
+{{range .Messages}}
+== {{.Name}} ({{.Time.Format "2006-01-02 15:04"}})
+{{.URL}}
+{{range $name, $value := .Fields}}{{$name}}: {{$value}}
+{{end}}{{if .Diff}}
+{{.Diff}}{{end}}{{if .Suppressed}}
+{{.Suppressed}} earlier notification(s) were suppressed.{{end}}
+{{end}}`))
+
+	digestHTML = htemplate.Must(htemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>nyfiken digest</title>
+</head>
+<body>
+{{range .Messages}}<h2><a href="{{.URL}}">{{.Name}}</a></h2>
+<p>{{.Time.Format "2006-01-02 15:04"}}</p>
+{{if .Fields}}<dl>
+{{range $name, $value := .Fields}}<dt>{{$name}}</dt><dd>{{$value}}</dd>
+{{end}}</dl>
+{{end}}{{if .Diff}}<pre>{{.Diff}}</pre>{{else}}{{.Content}}{{end}}
+{{if .Suppressed}}<p>{{.Suppressed}} earlier notification(s) were suppressed.</p>
+{{end}}<hr>
+{{end}}</body>
+</html>
+`))
+)
+
+// digestData is the data which digest templates are executed with.
+type digestData struct {
+	Time     time.Time
+	Messages []templateData
+}
+
+// SendDigest sends a single mail about several updated pages to a mail
+// address.
+func SendDigest(receivingMail string, msgs []*Message) (err error) {
+	buf, err := BuildDigest(settings.Global().SenderMail.Address, receivingMail, msgs, time.Now())
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return send(receivingMail, buf)
+}
+
+// BuildDigest returns a MIME encoded mail message from the sending to the
+// receiving mail address which lists several updated pages.
+func BuildDigest(sendingMail, receivingMail string, msgs []*Message, date time.Time) (buf []byte, err error) {
+	data := digestData{Time: date}
+	for _, msg := range msgs {
+		data.Messages = append(data.Messages, templateData{Message: msg, Content: htemplate.HTML(msg.Content)})
+	}
+
+	subject := new(bytes.Buffer)
+	err = digestSubject.Execute(subject, data)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	text := new(bytes.Buffer)
+	err = digestText.Execute(text, data)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	html := new(bytes.Buffer)
+	err = digestHTML.Execute(html, data)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+
+	return build(sendingMail, receivingMail, date, subject.String(), text.String(), html.String(), "")
+}
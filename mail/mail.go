@@ -2,48 +2,336 @@
 package mail
 
 import (
-	"net/smtp"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	htemplate "html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
 	"net/url"
+	"strings"
+	ttemplate "text/template"
+	"time"
 
 	"github.com/karlek/nyfiken/settings"
 	"github.com/mewkiz/pkg/errutil"
 )
 
-// Send sends a mail to a mail address with the contents of the checked page and
-// the URL to the checked page.
-func Send(pageUrl *url.URL, receivingMail string, body string) (err error) {
-	// Set up authentication information.
-	auth := smtp.PlainAuth(
-		"",
-		settings.Global.SenderMail.Address,
-		settings.Global.SenderMail.Password,
-		settings.Global.SenderMail.AuthServer,
-	)
-
-	// NOTE: The mail contains closing body and html tags, but no opening tags.
-
-	// Connect to the server, authenticate, set the sender and recipient,
-	// and send the email all in one step.
-	var msg = `From: ` + settings.Global.SenderMail.Address + `
-To: ` + receivingMail + `
-Subject: [ nyfiken ] ` + pageUrl.Host + `: update
-MIME-Version: 1.0
-Content-Transfer-Encoding: 8bit
-Content-Type: text/html; charset="UTF-8"
-
-` + `<a href="` + pageUrl.String() + `">` + pageUrl.String() + `</a> has been updated :) <hr>
-` + body + `</body><html>` + settings.Newline
-
-	err = smtp.SendMail(
-		settings.Global.SenderMail.OutServer, // Outgoing server.
-		auth, // Authorization information.
-		settings.Global.SenderMail.Address, // From what mail.
-		[]string{receivingMail},            // To which mail.
-		[]byte(msg),                        // Content to send.
-	)
+// Message is a notification mail about an updated page.
+type Message struct {
+	URL      *url.URL          // URL of the updated page.
+	Name     string            // Name of the page.
+	Time     time.Time         // Time of detection.
+	Diff     string            // Differing lines between the last and current check.
+	Content  string            // HTML selection of the page.
+	Fields   map[string]string // Values of the named fields of the page.
+	Snapshot string            // Full HTML of the page, attached unless empty.
+
+	// Number of suppressed notifications about the page since the last one.
+	Suppressed int
+}
+
+// Default templates of notification mails. The templates are executed with a
+// Message, where Content is HTML which isn't escaped.
+const (
+	DefaultSubject = `[ nyfiken ] {{.Name}}: update`
+
+	DefaultText = `{{.URL}} has been updated :)
+{{range $name, $value := .Fields}}
+{{$name}}: {{$value}}{{end}}
+{{if .Diff}}
+{{.Diff}}{{end}}{{if .Suppressed}}
+{{.Suppressed}} earlier notification(s) were suppressed.{{end}}`
+
+	DefaultHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+</head>
+<body>
+<a href="{{.URL}}">{{.URL}}</a> has been updated :) <hr>
+{{if .Fields}}<dl>
+{{range $name, $value := .Fields}}<dt>{{$name}}</dt><dd>{{$value}}</dd>
+{{end}}</dl><hr>
+{{end}}{{.Content}}
+{{if .Suppressed}}<hr>
+<p>{{.Suppressed}} earlier notification(s) were suppressed.</p>
+{{end}}</body>
+</html>
+`
+)
+
+// Templates are the parsed templates of notification mails.
+type Templates struct {
+	Subject *ttemplate.Template
+	Text    *ttemplate.Template
+	HTML    *htemplate.Template
+}
+
+// LoadTemplates parses the templates of notification mails; the subject
+// template string and the plain text and HTML template files of the body. The
+// default template is used for each empty argument.
+func LoadTemplates(subject, textPath, htmlPath string) (t *Templates, err error) {
+	if subject == "" {
+		subject = DefaultSubject
+	}
+	text, err := readTemplate(textPath, DefaultText)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	html, err := readTemplate(htmlPath, DefaultHTML)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+
+	t = new(Templates)
+	t.Subject, err = ttemplate.New("subject").Parse(subject)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	t.Text, err = ttemplate.New("text").Parse(text)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	t.HTML, err = htemplate.New("html").Parse(html)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return t, nil
+}
+
+// readTemplate returns the contents of the template file at path, or def if
+// path is empty.
+func readTemplate(path, def string) (s string, err error) {
+	if path == "" {
+		return def, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errutil.Err(err)
+	}
+	return string(buf), nil
+}
+
+// Send sends a notification mail about an updated page to a mail address.
+func Send(receivingMail string, msg *Message) (err error) {
+	global := settings.Global()
+	format := &global.MailFormat
+	t, err := LoadTemplates(format.Subject, format.Text, format.HTML)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if !format.Attach {
+		m := *msg
+		m.Snapshot = ""
+		msg = &m
+	}
+
+	buf, err := Build(global.SenderMail.Address, receivingMail, msg, t)
 	if err != nil {
 		return errutil.Err(err)
 	}
 
+	return send(receivingMail, buf)
+}
+
+// send sends a MIME encoded mail message to a mail address using the global
+// sender settings.
+func send(receivingMail string, buf []byte) (err error) {
+	sender := &settings.Global().SenderMail
+	server := &Server{
+		Addr:     sender.OutServer,
+		Security: sender.Security,
+		Auth:     sender.Auth,
+		AuthHost: sender.AuthServer,
+		Username: sender.Address,
+		Password: sender.Password,
+	}
+	err = server.Send(sender.Address, []string{receivingMail}, buf)
+	if err != nil {
+		return errutil.Err(err)
+	}
 	return nil
 }
+
+// templateData is the data which templates are executed with.
+type templateData struct {
+	*Message
+	Content htemplate.HTML // The selection is trusted to be HTML.
+}
+
+// crlf is the line ending of mail messages.
+const crlf = "\r\n"
+
+// Build returns a MIME encoded mail message from the sending to the receiving
+// mail address. The body is multipart/alternative with a plain text and an
+// HTML part, wrapped in multipart/mixed if the snapshot is attached.
+func Build(sendingMail, receivingMail string, msg *Message, t *Templates) (buf []byte, err error) {
+	data := templateData{Message: msg, Content: htemplate.HTML(msg.Content)}
+
+	subject := new(bytes.Buffer)
+	err = t.Subject.Execute(subject, data)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	text := new(bytes.Buffer)
+	err = t.Text.Execute(text, data)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	html := new(bytes.Buffer)
+	err = t.HTML.Execute(html, data)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+
+	return build(sendingMail, receivingMail, msg.Time, subject.String(), text.String(), html.String(), msg.Snapshot)
+}
+
+// build returns a MIME encoded mail message with the provided subject and
+// plain text and HTML bodies. The snapshot is attached unless empty.
+func build(sendingMail, receivingMail string, date time.Time, subject, text, html, snapshot string) (buf []byte, err error) {
+	if date.IsZero() {
+		date = time.Now()
+	}
+	messageID, err := newMessageID(sendingMail)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+
+	b := new(bytes.Buffer)
+	writeHeader(b, "From", sendingMail)
+	writeHeader(b, "To", receivingMail)
+	writeHeader(b, "Subject", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)))
+	writeHeader(b, "Date", date.Format(time.RFC1123Z))
+	writeHeader(b, "Message-ID", messageID)
+	writeHeader(b, "MIME-Version", "1.0")
+
+	altBoundary := multipart.NewWriter(nil).Boundary()
+	if snapshot == "" {
+		writeHeader(b, "Content-Type", "multipart/alternative; boundary="+altBoundary)
+		b.WriteString(crlf)
+		err = writeAlternative(b, altBoundary, text, html)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		return b.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(b)
+	writeHeader(b, "Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	b.WriteString(crlf)
+
+	// Alternative text and HTML body.
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "multipart/alternative; boundary="+altBoundary)
+	w, err := mixed.CreatePart(h)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	err = writeAlternative(w, altBoundary, text, html)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+
+	// Snapshot attachment.
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Type", `text/html; charset="UTF-8"`)
+	h.Set("Content-Transfer-Encoding", "base64")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "snapshot.htm"}))
+	w, err = mixed.CreatePart(h)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	err = writeBase64(w, []byte(snapshot))
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+
+	err = mixed.Close()
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return b.Bytes(), nil
+}
+
+// writeHeader writes a header field of a mail message.
+func writeHeader(w io.Writer, key, value string) {
+	fmt.Fprintf(w, "%s: %s%s", key, value, crlf)
+}
+
+// writeAlternative writes a multipart/alternative body with a plain text and an
+// HTML part using the provided boundary.
+func writeAlternative(w io.Writer, boundary, text, html string) (err error) {
+	alt := multipart.NewWriter(w)
+	err = alt.SetBoundary(boundary)
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{`text/plain; charset="UTF-8"`, text},
+		{`text/html; charset="UTF-8"`, html},
+	}
+	for _, part := range parts {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", part.contentType)
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := alt.CreatePart(h)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		qw := quotedprintable.NewWriter(pw)
+		_, err = io.WriteString(qw, part.body)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		err = qw.Close()
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+	return alt.Close()
+}
+
+// writeBase64 writes buf base64 encoded with lines of at most 76 characters.
+func writeBase64(w io.Writer, buf []byte) (err error) {
+	const lineLen = 76
+	enc := base64.StdEncoding.EncodeToString(buf)
+	for len(enc) > 0 {
+		n := lineLen
+		if n > len(enc) {
+			n = len(enc)
+		}
+		_, err = io.WriteString(w, enc[:n]+crlf)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		enc = enc[n:]
+	}
+	return nil
+}
+
+// newMessageID returns a unique Message-ID in the domain of the sending mail
+// address.
+func newMessageID(sendingMail string) (id string, err error) {
+	domain := "nyfiken"
+	if i := strings.LastIndex(sendingMail, "@"); i != -1 {
+		domain = sendingMail[i+1:]
+	}
+	var buf [8]byte
+	_, err = rand.Read(buf[:])
+	if err != nil {
+		return "", errutil.Err(err)
+	}
+	return fmt.Sprintf("<%d.%x@%s>", time.Now().UnixNano(), buf, domain), nil
+}
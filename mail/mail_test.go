@@ -0,0 +1,191 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMessage(t *testing.T) *Message {
+	u, err := url.Parse("http://räksmörgås.example.org/news")
+	if err != nil {
+		t.Fatal("url.Parse:", err)
+	}
+	return &Message{
+		URL:     u,
+		Name:    u.Host,
+		Time:    time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+		Diff:    "-old\n+new\n",
+		Content: "<p>new</p>",
+		Fields:  map[string]string{"price": "1299"},
+	}
+}
+
+// readParts returns the media types and decoded bodies of the parts of a
+// multipart body. Quoted-printable parts are decoded by multipart.Reader.
+func readParts(t *testing.T, contentType string, body []byte) (types []string, bodies []string) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal("mime.ParseMediaType:", err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		t.Fatalf("media type %q is not multipart", mediaType)
+	}
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		var pr io.Reader = p
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			pr = base64.NewDecoder(base64.StdEncoding, p)
+		}
+		buf, err := ioutil.ReadAll(pr)
+		if err != nil {
+			t.Fatal("ioutil.ReadAll:", err)
+		}
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(buf))
+	}
+	return types, bodies
+}
+
+func TestBuild(t *testing.T) {
+	tmpl, err := LoadTemplates("", "", "")
+	if err != nil {
+		t.Fatal("LoadTemplates:", err)
+	}
+	buf, err := Build("sender@example.com", "recv@example.com", testMessage(t), tmpl)
+	if err != nil {
+		t.Fatal("Build:", err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal("mail.ReadMessage:", err)
+	}
+
+	// Headers.
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal("DecodeHeader:", err)
+	}
+	if want := "[ nyfiken ] räksmörgås.example.org: update"; subject != want {
+		t.Errorf("subject %q != expected %q", subject, want)
+	}
+	if strings.ContainsAny(msg.Header.Get("Subject"), "äö") {
+		t.Errorf("subject %q is not encoded", msg.Header.Get("Subject"))
+	}
+	date, err := msg.Header.Date()
+	if err != nil {
+		t.Fatal("Date:", err)
+	}
+	if !date.Equal(time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("date %v is invalid", date)
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("message-ID %q is invalid", id)
+	}
+
+	// Alternative text and HTML parts.
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal("ioutil.ReadAll:", err)
+	}
+	types, bodies := readParts(t, msg.Header.Get("Content-Type"), body)
+	if len(types) != 2 || !strings.HasPrefix(types[0], "text/plain") || !strings.HasPrefix(types[1], "text/html") {
+		t.Fatalf("parts %v != expected text/plain and text/html", types)
+	}
+	if !strings.Contains(bodies[0], "price: 1299") || !strings.Contains(bodies[0], "+new") {
+		t.Errorf("text part %q lacks fields or diff", bodies[0])
+	}
+	if !strings.HasPrefix(bodies[1], "<!DOCTYPE html>") || !strings.Contains(bodies[1], "<p>new</p>") || !strings.Contains(bodies[1], "</html>") {
+		t.Errorf("HTML part %q is invalid", bodies[1])
+	}
+}
+
+func TestBuildAttachment(t *testing.T) {
+	tmpl, err := LoadTemplates("{{.Name}} changed", "", "")
+	if err != nil {
+		t.Fatal("LoadTemplates:", err)
+	}
+	m := testMessage(t)
+	m.Name = "news"
+	m.Snapshot = "<html><body><p>new</p></body></html>"
+	buf, err := Build("sender@example.com", "recv@example.com", m, tmpl)
+	if err != nil {
+		t.Fatal("Build:", err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal("mail.ReadMessage:", err)
+	}
+	if subject := msg.Header.Get("Subject"); subject != "news changed" {
+		t.Errorf("subject %q != expected %q", subject, "news changed")
+	}
+
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal("ioutil.ReadAll:", err)
+	}
+	types, bodies := readParts(t, msg.Header.Get("Content-Type"), body)
+	if len(types) != 2 || !strings.HasPrefix(types[0], "multipart/alternative") || !strings.HasPrefix(types[1], "text/html") {
+		t.Fatalf("parts %v != expected multipart/alternative and text/html", types)
+	}
+	altTypes, _ := readParts(t, types[0], []byte(bodies[0]))
+	if len(altTypes) != 2 {
+		t.Errorf("alternative parts %v != expected 2 parts", altTypes)
+	}
+	if bodies[1] != m.Snapshot {
+		t.Errorf("attachment %q != expected %q", bodies[1], m.Snapshot)
+	}
+}
+
+func TestBuildDigest(t *testing.T) {
+	a := testMessage(t)
+	b := testMessage(t)
+	b.Name = "second"
+	b.Diff = ""
+	b.Content = "<p>only content</p>"
+	buf, err := BuildDigest("sender@example.com", "recv@example.com", []*Message{a, b}, time.Now())
+	if err != nil {
+		t.Fatal("BuildDigest:", err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal("mail.ReadMessage:", err)
+	}
+	if subject := msg.Header.Get("Subject"); subject != "[ nyfiken ] 2 updated pages" {
+		t.Errorf("subject %q != expected %q", subject, "[ nyfiken ] 2 updated pages")
+	}
+
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal("ioutil.ReadAll:", err)
+	}
+	types, bodies := readParts(t, msg.Header.Get("Content-Type"), body)
+	if len(types) != 2 {
+		t.Fatalf("parts %v != expected text/plain and text/html", types)
+	}
+	for _, want := range []string{"== räksmörgås.example.org", "== second", "+new", "price: 1299"} {
+		if !strings.Contains(bodies[0], want) {
+			t.Errorf("text part %q lacks %q", bodies[0], want)
+		}
+	}
+	for _, want := range []string{"<pre>-old\r\n&#43;new\r\n</pre>", "<p>only content</p>"} {
+		if !strings.Contains(bodies[1], want) {
+			t.Errorf("HTML part %q lacks %q", bodies[1], want)
+		}
+	}
+}
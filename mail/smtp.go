@@ -0,0 +1,180 @@
+package mail
+
+import (
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Security modes of the connection to the outgoing server.
+const (
+	SecurityTLS      = "tls"      // Implicit TLS, usually on port 465.
+	SecurityStartTLS = "starttls" // Required STARTTLS, usually on port 587.
+	SecurityNone     = "none"     // No encryption, e.g. for a local relay.
+)
+
+// Authentication mechanisms of the outgoing server.
+const (
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+	AuthNone    = "none"
+)
+
+// Server is an outgoing mail server.
+type Server struct {
+	Addr      string      // Address of the server, e.g. "smtp.example.com:465".
+	Security  string      // Security mode of the connection; defaults to STARTTLS.
+	Auth      string      // Authentication mechanism; defaults to PLAIN.
+	AuthHost  string      // Host name to authenticate against; defaults to the host of Addr.
+	Username  string      // Username to authenticate with.
+	Password  string      // Password to authenticate with.
+	TLSConfig *tls.Config // TLS configuration; nil to verify the host of Addr.
+}
+
+// Send connects to the server, authenticates, and sends msg from the sending
+// mail address to the receiving mail addresses.
+func (s *Server) Send(from string, to []string, msg []byte) (err error) {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	config := s.TLSConfig
+	if config == nil {
+		config = &tls.Config{ServerName: host}
+	}
+
+	security := s.Security
+	if security == "" {
+		security = SecurityStartTLS
+	}
+
+	// Connect to the server.
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: settings.TimeoutDuration}
+	switch security {
+	case SecurityTLS:
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.Addr, config)
+	case SecurityStartTLS, SecurityNone:
+		conn, err = dialer.Dial("tcp", s.Addr)
+	default:
+		return errutil.NewNoPosf("mail: invalid security mode `%s`", security)
+	}
+	if err != nil {
+		return errutil.Err(err)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return errutil.Err(err)
+	}
+	defer c.Close()
+
+	if security == SecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errutil.NewNoPosf("mail: %s doesn't support STARTTLS", s.Addr)
+		}
+		err = c.StartTLS(config)
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+
+	// Authenticate.
+	if s.Auth != AuthNone {
+		auth, err := s.auth(host)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errutil.NewNoPosf("mail: %s doesn't support authentication", s.Addr)
+		}
+		err = c.Auth(auth)
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+
+	// Set the sender and recipients and send the message.
+	err = c.Mail(from)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	for _, addr := range to {
+		err = c.Rcpt(addr)
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	err = w.Close()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return c.Quit()
+}
+
+// auth returns the authentication mechanism of the server.
+func (s *Server) auth(host string) (auth smtp.Auth, err error) {
+	authHost := s.AuthHost
+	if authHost == "" {
+		authHost = host
+	}
+	switch s.Auth {
+	case AuthPlain, "":
+		return smtp.PlainAuth("", s.Username, s.Password, authHost), nil
+	case AuthLogin:
+		return &loginAuth{username: s.Username, password: s.Password, host: authHost}, nil
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(s.Username, s.Password), nil
+	}
+	return nil, errutil.NewNoPosf("mail: invalid authentication mechanism `%s`", s.Auth)
+}
+
+// loginAuth implements the LOGIN authentication mechanism. Like PLAIN it sends
+// the password in the clear, so it's only used over TLS or to localhost.
+type loginAuth struct {
+	username, password, host string
+}
+
+// Start begins an authentication with a server.
+func (a *loginAuth) Start(server *smtp.ServerInfo) (proto string, toServer []byte, err error) {
+	if !server.TLS && !IsLocalhost(server.Name) {
+		return "", nil, errutil.NewNoPos("mail: unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errutil.NewNoPos("mail: wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next continues the authentication with the server challenge fromServer.
+func (a *loginAuth) Next(fromServer []byte, more bool) (toServer []byte, err error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, errutil.NewNoPosf("mail: unexpected LOGIN challenge `%s`", fromServer)
+}
+
+// IsLocalhost reports whether host is the local machine, to which passwords may
+// be sent unencrypted.
+func IsLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
@@ -0,0 +1,308 @@
+package mail
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testUser = "sender@example.com"
+	testPass = "123456"
+)
+
+// session is what a fake SMTP server received during a session.
+type session struct {
+	TLS  bool     // The session was encrypted.
+	Auth string   // Authentication mechanism used, if any.
+	From string   // Sender of the message.
+	To   []string // Recipients of the message.
+	Data string   // The message.
+	Err  error    // Error of the server.
+}
+
+// fakeServer is a minimal SMTP server which accepts a single session.
+type fakeServer struct {
+	ln       net.Listener
+	config   *tls.Config
+	implicit bool // Use implicit TLS.
+	startTLS bool // Offer STARTTLS.
+	done     chan session
+}
+
+// newFakeServer starts a fake SMTP server on the loopback interface.
+func newFakeServer(t *testing.T, config *tls.Config, implicit, startTLS bool) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	s := &fakeServer{ln: ln, config: config, implicit: implicit, startTLS: startTLS, done: make(chan session, 1)}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	defer s.ln.Close()
+	conn, err := s.ln.Accept()
+	if err != nil {
+		s.done <- session{Err: err}
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var sess session
+	if s.implicit {
+		conn = tls.Server(conn, s.config)
+		sess.TLS = true
+	}
+	sess.Err = s.handle(conn, &sess)
+	s.done <- sess
+}
+
+func (s *fakeServer) handle(conn net.Conn, sess *session) (err error) {
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return err
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(strings.TrimPrefix(line, line[:len(cmd)]))
+		switch cmd {
+		case "EHLO", "HELO":
+			exts := []string{"fake"}
+			if s.startTLS && !sess.TLS {
+				exts = append(exts, "STARTTLS")
+			}
+			exts = append(exts, "AUTH PLAIN LOGIN CRAM-MD5")
+			for i, ext := range exts {
+				sep := "-"
+				if i == len(exts)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, ext)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tc := tls.Server(conn, s.config)
+			err = tc.Handshake()
+			if err != nil {
+				return err
+			}
+			conn, sess.TLS = tc, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			sess.Auth = strings.SplitN(arg, " ", 2)[0]
+			ok, err := auth(tp, arg)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				tp.PrintfLine("535 authentication failed")
+				continue
+			}
+			tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			sess.From = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			sess.To = append(sess.To, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			buf, err := tp.ReadDotBytes()
+			if err != nil {
+				return err
+			}
+			sess.Data = string(buf)
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return nil
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+// auth performs the server side of an AUTH command and reports whether the
+// client provided the test credentials.
+func auth(tp *textproto.Conn, arg string) (ok bool, err error) {
+	// challenge sends a challenge and returns the decoded response.
+	challenge := func(s string) (string, error) {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(s)))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		buf, err := base64.StdEncoding.DecodeString(line)
+		return string(buf), err
+	}
+
+	args := strings.Fields(arg)
+	switch strings.ToUpper(args[0]) {
+	case "PLAIN":
+		var resp string
+		if len(args) > 1 {
+			buf, err := base64.StdEncoding.DecodeString(args[1])
+			if err != nil {
+				return false, err
+			}
+			resp = string(buf)
+		} else if resp, err = challenge(""); err != nil {
+			return false, err
+		}
+		return resp == "\x00"+testUser+"\x00"+testPass, nil
+	case "LOGIN":
+		user, err := challenge("Username:")
+		if err != nil {
+			return false, err
+		}
+		pass, err := challenge("Password:")
+		if err != nil {
+			return false, err
+		}
+		return user == testUser && pass == testPass, nil
+	case "CRAM-MD5":
+		const nonce = "<1896.697170952@fake>"
+		resp, err := challenge(nonce)
+		if err != nil {
+			return false, err
+		}
+		h := hmac.New(md5.New, []byte(testPass))
+		h.Write([]byte(nonce))
+		return resp == testUser+" "+hex.EncodeToString(h.Sum(nil)), nil
+	}
+	return false, fmt.Errorf("unknown mechanism %q", args[0])
+}
+
+// testTLSConfigs returns the TLS configurations of a server with a self-signed
+// certificate for 127.0.0.1 and of a client which trusts it.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("ecdsa.GenerateKey:", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("x509.CreateCertificate:", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("x509.ParseCertificate:", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{ServerName: "127.0.0.1", RootCAs: pool}
+	return server, client
+}
+
+func TestServerSend(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+
+	golden := []struct {
+		security string
+		auth     string
+		pass     string
+		startTLS bool // The server offers STARTTLS.
+		wantTLS  bool
+		wantAuth string
+		wantErr  bool
+	}{
+		// i=0
+		{security: SecurityTLS, auth: AuthPlain, pass: testPass, wantTLS: true, wantAuth: "PLAIN"},
+		// i=1
+		{security: SecurityStartTLS, auth: AuthLogin, pass: testPass, startTLS: true, wantTLS: true, wantAuth: "LOGIN"},
+		// i=2
+		{security: SecurityStartTLS, auth: AuthCRAMMD5, pass: testPass, startTLS: true, wantTLS: true, wantAuth: "CRAM-MD5"},
+		// i=3
+		{security: SecurityNone, auth: AuthNone, startTLS: true},
+		// i=4
+		{security: SecurityNone, auth: AuthPlain, pass: testPass, wantAuth: "PLAIN"},
+		// i=5
+		{security: SecurityStartTLS, auth: AuthPlain, pass: testPass, wantErr: true},
+		// i=6
+		{security: SecurityTLS, auth: AuthLogin, pass: "wrong", wantTLS: true, wantAuth: "LOGIN", wantErr: true},
+	}
+
+	for i, g := range golden {
+		fs := newFakeServer(t, serverConfig, g.security == SecurityTLS, g.startTLS)
+		s := &Server{
+			Addr:      fs.ln.Addr().String(),
+			Security:  g.security,
+			Auth:      g.auth,
+			Username:  testUser,
+			Password:  g.pass,
+			TLSConfig: clientConfig,
+		}
+		err := s.Send(testUser, []string{"recv@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n"))
+		if g.wantErr {
+			if err == nil {
+				t.Errorf("i=%d: expected error, got nil", i)
+			}
+			<-fs.done
+			continue
+		}
+		if err != nil {
+			t.Errorf("i=%d: Send: %v", i, err)
+			continue
+		}
+
+		sess := <-fs.done
+		if sess.Err != nil {
+			t.Errorf("i=%d: server: %v", i, sess.Err)
+			continue
+		}
+		if sess.TLS != g.wantTLS {
+			t.Errorf("i=%d: TLS: expected %v, got %v", i, g.wantTLS, sess.TLS)
+		}
+		if sess.Auth != g.wantAuth {
+			t.Errorf("i=%d: auth: expected %q, got %q", i, g.wantAuth, sess.Auth)
+		}
+		if sess.From != testUser {
+			t.Errorf("i=%d: from: expected %q, got %q", i, testUser, sess.From)
+		}
+		if len(sess.To) != 1 || sess.To[0] != "recv@example.com" {
+			t.Errorf("i=%d: to: expected [recv@example.com], got %v", i, sess.To)
+		}
+		if !strings.Contains(sess.Data, "body") {
+			t.Errorf("i=%d: data: expected body, got %q", i, sess.Data)
+		}
+	}
+}
+
+func TestLoginAuthUnencrypted(t *testing.T) {
+	a := &loginAuth{username: testUser, password: testPass, host: "smtp.example.com"}
+	_, _, err := a.Start(&smtp.ServerInfo{Name: "smtp.example.com"})
+	if err == nil {
+		t.Error("expected error for an unencrypted connection, got nil")
+	}
+}
@@ -0,0 +1,305 @@
+// Package metrics records metrics of nyfikend and serves them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Kinds of check failures.
+const (
+	FailTimeout    = "timeout"         // The download timed out.
+	FailHTTPStatus = "http_status"     // The page responded with a client or server error.
+	FailEmpty      = "empty_selection" // The selection of the page was empty.
+	FailFetch      = "fetch"           // The page couldn't be downloaded.
+	FailOther      = "other"           // Any other error.
+)
+
+// Metrics of nyfikend.
+var (
+	Checks = NewCounter("nyfiken_checks_total",
+		"Number of performed page checks.", "page", "host")
+	CheckFailures = NewCounter("nyfiken_check_failures_total",
+		"Number of failed page checks by kind of failure.", "page", "host", "kind")
+	FetchDuration = NewHistogram("nyfiken_fetch_duration_seconds",
+		"Duration of page downloads in seconds.",
+		[]float64{.1, .25, .5, 1, 2.5, 5, 10, 30}, "page", "host")
+	Updates = NewCounter("nyfiken_updates_total",
+		"Number of detected page updates.", "page", "host")
+	Notifications = NewCounter("nyfiken_notifications_total",
+		"Number of sent notifications.", "page", "host")
+	NotificationFailures = NewCounter("nyfiken_notification_failures_total",
+		"Number of notifications which failed to send.", "page", "host")
+	Pages = NewGauge("nyfiken_pages",
+		"Number of checked pages.")
+)
+
+// metric is a registered metric.
+type metric interface {
+	write(w io.Writer) error
+}
+
+// registry are the registered metrics, in order of registration.
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+// register adds the metric to the registry.
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// desc describes a metric and its labels.
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// key returns the key of label values, which panics if the number of values
+// differs from the number of labels.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// header writes the HELP and TYPE lines of the metric.
+func (d *desc) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, typ)
+}
+
+// labelPairs formats the labels of the key, with an optional extra label.
+func (d *desc) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escape(v)+`"`)
+		}
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+escape(extra[1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escape escapes a label value.
+var escape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+
+// formatFloat formats a sample value.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of the map sorted.
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value per set of label values which only increases.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter returns a new registered counter with the labels.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, labels}, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// Inc increments the counter of the label values by 1.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter of the label values.
+func (c *Counter) Add(v float64, values ...string) {
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+// Value returns the counter of the label values.
+func (c *Counter) Value(values ...string) float64 {
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(key), formatFloat(c.values[key]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gauge is a value per set of label values which may go up and down.
+type Gauge struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewGauge returns a new registered gauge with the labels.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{name, help, labels}, values: make(map[string]float64)}
+	register(g)
+	return g
+}
+
+// Set sets the gauge of the label values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	key := g.key(values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[key] = v
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header(w, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelPairs(key), formatFloat(g.values[key]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts observations per set of label values in buckets.
+type Histogram struct {
+	desc
+	buckets []float64 // Upper bounds of the buckets, in increasing order.
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// histogramValue are the observations of a set of label values.
+type histogramValue struct {
+	counts []uint64 // Number of observations per bucket.
+	count  uint64   // Total number of observations.
+	sum    float64  // Sum of observations.
+}
+
+// NewHistogram returns a new registered histogram with the bucket upper bounds
+// and the labels.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{desc: desc{name, help, labels}, buckets: buckets, values: make(map[string]*histogramValue)}
+	register(h)
+	return h
+}
+
+// Observe adds an observation of v for the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", formatFloat(bound)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(key), formatFloat(hv.sum))
+		_, err := fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(key), hv.count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format.
+func WriteText(w io.Writer) (err error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, m := range registry {
+		err = m.write(bw)
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+	err = bw.Flush()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// Handler returns an HTTP handler which serves all metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := WriteText(w)
+		if err != nil {
+			slog.Error("unable to write metrics", "err", err)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	registry = nil
+	c := NewCounter("test_total", "Test counter.", "page", "kind")
+	g := NewGauge("test_pages", "Test gauge.")
+	h := NewHistogram("test_seconds", "Test histogram.", []float64{1, 5}, "host")
+
+	c.Inc("http://example.org/", "timeout")
+	c.Add(2, "http://example.org/", "timeout")
+	c.Inc(`http://example.org/"q"`, "other")
+	g.Set(3)
+	h.Observe(0.5, "example.org")
+	h.Observe(2, "example.org")
+	h.Observe(10, "example.org")
+
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{page="http://example.org/\"q\"",kind="other"} 1
+test_total{page="http://example.org/",kind="timeout"} 3
+# HELP test_pages Test gauge.
+# TYPE test_pages gauge
+test_pages 3
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{host="example.org",le="1"} 1
+test_seconds_bucket{host="example.org",le="5"} 2
+test_seconds_bucket{host="example.org",le="+Inf"} 3
+test_seconds_sum{host="example.org"} 12.5
+test_seconds_count{host="example.org"} 3
+`
+	buf := new(bytes.Buffer)
+	err := WriteText(buf)
+	if err != nil {
+		t.Fatal("WriteText:", err)
+	}
+	if buf.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, buf)
+	}
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if w.Body.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, w.Body)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	c := &Counter{desc: desc{name: "test_total", labels: []string{"page"}}, values: make(map[string]float64)}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic on missing label value")
+		}
+	}()
+	c.Inc()
+}
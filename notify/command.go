@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Command is a notifier which runs a user command when a page has been updated.
+// The command is given information about the update through the environment
+// variables:
+//
+//	NYFIKEN_URL         URL of the updated page.
+//	NYFIKEN_NAME        Name of the updated page.
+//	NYFIKEN_DISTANCE    Percentage of deviation from the last check.
+//	NYFIKEN_CACHE_FILE  Path to the cached, i.e. new, selection of the page.
+//	NYFIKEN_DIFF_FILE   Path to a temporary file with the differing lines.
+//	NYFIKEN_SUPPRESSED  Number of suppressed notifications since the last one.
+type Command struct {
+	Command string        // Command line; the command followed by its arguments, which may be quoted.
+	Timeout time.Duration // Duration the command may run before it is killed.
+}
+
+// Notify runs the command and logs its output.
+func (c *Command) Notify(up *Update) (err error) {
+	args, err := splitCommand(c.Command)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if len(args) == 0 {
+		return errutil.NewNoPosf("command: missing command for %s", up.URL)
+	}
+
+	// Write the diff to a temporary file which is removed once the command has
+	// finished.
+	diffFile, err := ioutil.TempFile("", "nyfiken-diff-")
+	if err != nil {
+		return errutil.Err(err)
+	}
+	defer os.Remove(diffFile.Name())
+	_, err = diffFile.WriteString(up.Diff)
+	if err != nil {
+		diffFile.Close()
+		return errutil.Err(err)
+	}
+	err = diffFile.Close()
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"NYFIKEN_URL="+up.URL.String(),
+		"NYFIKEN_NAME="+up.Name,
+		fmt.Sprintf("NYFIKEN_DISTANCE=%g", up.Distance),
+		"NYFIKEN_CACHE_FILE="+up.CacheFile,
+		"NYFIKEN_DIFF_FILE="+diffFile.Name(),
+		fmt.Sprintf("NYFIKEN_SUPPRESSED=%d", up.Suppressed),
+	)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+
+	if output := strings.TrimSpace(out.String()); output != "" {
+		slog.Info("on_update output", "page", up.URL.String(), "command", args[0], "output", output)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return errutil.NewNoPosf("command: timeout: %s", args[0])
+	}
+	if err != nil {
+		return errutil.NewNoPosf("command: %s: %v", args[0], err)
+	}
+	return nil
+}
+
+// splitCommand splits a command line into the command and its arguments. As in
+// a shell, arguments are separated by whitespace, which is kept inside single
+// or double quotes or when escaped by a backslash, e.g.
+//
+//	"/home/user/my scripts/archive" --title 'Page updated'
+func splitCommand(line string) (args []string, err error) {
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errutil.NewNoPosf("command: unterminated quote or escape in `%s`", line)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,91 @@
+package notify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The script records its environment and the contents of the diff file.
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "on_update.sh")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$NYFIKEN_URL $NYFIKEN_CACHE_FILE\" > "+out+"\ncat \"$NYFIKEN_DIFF_FILE\" >> "+out+"\n"), 0700)
+	if err != nil {
+		t.Fatal("ioutil.WriteFile:", err)
+	}
+
+	up := testUpdate(t)
+	up.CacheFile = "/cache/example.org.htm"
+	c := &Command{Command: script, Timeout: 10 * time.Second}
+	err = c.Notify(up)
+	if err != nil {
+		t.Fatal("Notify:", err)
+	}
+
+	buf, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal("ioutil.ReadFile:", err)
+	}
+	got := string(buf)
+	want := "http://example.org/news /cache/example.org.htm\n-old\n+new\n"
+	if got != want {
+		t.Errorf("output %q != expected %q", got, want)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	c := &Command{Command: "sleep 10", Timeout: 50 * time.Millisecond}
+	err := c.Notify(testUpdate(t))
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	golden := []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		// i=0
+		{line: "notify-send  nyfiken\tupdated", want: []string{"notify-send", "nyfiken", "updated"}},
+		// i=1
+		{line: `"/home/user/my scripts/archive" --title 'Page updated'`, want: []string{"/home/user/my scripts/archive", "--title", "Page updated"}},
+		// i=2
+		{line: `echo it\'s "a \"b\"" '' c\ d`, want: []string{"echo", "it's", `a "b"`, "", "c d"}},
+		// i=3
+		{line: "", want: nil},
+		// i=4
+		{line: `echo 'unterminated`, wantErr: true},
+		// i=5
+		{line: `echo \`, wantErr: true},
+	}
+
+	for i, g := range golden {
+		got, err := splitCommand(g.line)
+		if g.wantErr {
+			if err == nil {
+				t.Errorf("i=%d: expected error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("i=%d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, g.want) {
+			t.Errorf("i=%d: output %q != expected %q", i, got, g.want)
+		}
+	}
+}
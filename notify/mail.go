@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"github.com/karlek/nyfiken/digest"
+	"github.com/karlek/nyfiken/mail"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Mail is a notifier which mails updates to an address.
+type Mail struct {
+	To string // Mail address to send notifications to.
+}
+
+// Notify mails a description of the update, or adds it to the pending digest
+// of the recipient.
+func (m *Mail) Notify(up *Update) (err error) {
+	sched, err := digest.ScheduleOf(m.To)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if sched.Kind != digest.Immediate {
+		e := digest.Entry{
+			URL:     up.URL.String(),
+			Name:    up.Name,
+			Time:    up.Time,
+			Diff:    up.Diff,
+			Content: up.Content,
+			Fields:  up.Fields,
+
+			Suppressed: up.Suppressed,
+		}
+		err = digest.Add(m.To, e)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		return nil
+	}
+
+	msg := &mail.Message{
+		URL:      up.URL,
+		Name:     up.Name,
+		Time:     up.Time,
+		Diff:     up.Diff,
+		Content:  up.Content,
+		Fields:   up.Fields,
+		Snapshot: up.Snapshot,
+
+		Suppressed: up.Suppressed,
+	}
+	err = mail.Send(m.To, msg)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// Digested reports whether updates to the recipient are added to a pending
+// digest instead of being mailed immediately.
+func (m *Mail) Digested() bool {
+	sched, err := digest.ScheduleOf(m.To)
+	return err == nil && sched.Kind != digest.Immediate
+}
@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"testing"
+
+	"github.com/karlek/nyfiken/settings"
+)
+
+func TestDigested(t *testing.T) {
+	defer settings.SetGlobal(settings.Global())
+	g := *settings.Global()
+	g.Digest.Default = "immediate"
+	g.Digest.Recipients = map[string]string{
+		"team@example.com": "daily@08:30",
+		"bad@example.com":  "weekly",
+	}
+	settings.SetGlobal(&g)
+
+	var golden = []struct {
+		to   string
+		want bool
+	}{
+		// i=0
+		{"user@example.com", false},
+		// i=1
+		{"team@example.com", true},
+		// i=2
+		{"bad@example.com", false},
+	}
+
+	for i, g := range golden {
+		m := &Mail{To: g.to}
+		if got := m.Digested(); got != g.want {
+			t.Errorf("i=%d: %s: output %v != expected %v", i, g.to, got, g.want)
+		}
+	}
+}
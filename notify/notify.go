@@ -0,0 +1,29 @@
+// Package notify delivers notifications about updated pages.
+package notify
+
+import (
+	"net/url"
+	"time"
+)
+
+// Update describes a detected update of a page.
+type Update struct {
+	URL       *url.URL          // URL of the updated page.
+	Name      string            // Name of the page.
+	Time      time.Time         // Time of detection.
+	Distance  float64           // Percentage of deviation from the last check.
+	Diff      string            // Differing lines between the last and current check.
+	Content   string            // Selection of the page without strip functions.
+	CacheFile string            // Path to the cached selection of the page.
+	Snapshot  string            // Full HTML of the page.
+	Fields    map[string]string // Values of the named fields of the page.
+
+	// Number of notifications about the page which have been suppressed since
+	// the last one, because the page was flapping or the rate limit was reached.
+	Suppressed int
+}
+
+// A Notifier delivers notifications about updates.
+type Notifier interface {
+	Notify(up *Update) error
+}
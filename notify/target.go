@@ -0,0 +1,23 @@
+package notify
+
+import (
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// FromTarget returns the notifiers of a notification target; one per mail
+// address of mail targets.
+func FromTarget(t settings.Target) (ns []Notifier, err error) {
+	switch t.Type {
+	case settings.TargetMail:
+		for _, to := range t.To {
+			ns = append(ns, &Mail{To: to})
+		}
+		return ns, nil
+	case settings.TargetWebhook:
+		return []Notifier{NewWebhook(t.URL, t.Payload, t.Retries)}, nil
+	case settings.TargetCommand:
+		return []Notifier{&Command{Command: t.Command, Timeout: t.Timeout}}, nil
+	}
+	return nil, errutil.NewNoPosf("notify: invalid target type `%s`", t.Type)
+}
@@ -0,0 +1,42 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/karlek/nyfiken/settings"
+)
+
+func TestFromTarget(t *testing.T) {
+	golden := []struct {
+		target  settings.Target
+		want    int
+		wantErr bool
+	}{
+		// i=0
+		{target: settings.Target{Type: settings.TargetMail, To: []string{"a@example.com", "b@example.com"}}, want: 2},
+		// i=1
+		{target: settings.Target{Type: settings.TargetWebhook, URL: "http://localhost/hook"}, want: 1},
+		// i=2
+		{target: settings.Target{Type: settings.TargetCommand, Command: "true", Timeout: time.Second}, want: 1},
+		// i=3
+		{target: settings.Target{Type: "pigeon"}, wantErr: true},
+	}
+
+	for i, g := range golden {
+		ns, err := FromTarget(g.target)
+		if g.wantErr {
+			if err == nil {
+				t.Errorf("i=%d: expected error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("i=%d: FromTarget: %v", i, err)
+			continue
+		}
+		if len(ns) != g.want {
+			t.Errorf("i=%d: expected %d notifiers, got %d", i, g.want, len(ns))
+		}
+	}
+}
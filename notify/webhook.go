@@ -0,0 +1,175 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Default values of webhooks.
+const (
+	// Default number of retries of failed deliveries.
+	DefaultRetries = 3
+
+	// Default delay before the first retry. The delay is doubled for each
+	// following retry.
+	DefaultRetryDelay = 2 * time.Second
+)
+
+// Webhook is a notifier which POSTs a JSON payload to an incoming webhook URL.
+type Webhook struct {
+	URL        string             // URL to POST notifications to.
+	Template   *template.Template // Template of the payload; nil for the default payload.
+	Retries    int                // Number of retries of failed deliveries.
+	RetryDelay time.Duration      // Delay before the first retry.
+	Client     *http.Client       // HTTP client; nil for a client with the default timeout.
+}
+
+// NewWebhook returns a webhook notifier for the provided URL. The payload is
+// rendered with the template parsed by ParseTemplate, or the default payload if
+// t is nil.
+func NewWebhook(url string, t *template.Template, retries int) *Webhook {
+	return &Webhook{
+		URL:        url,
+		Template:   t,
+		Retries:    retries,
+		RetryDelay: DefaultRetryDelay,
+	}
+}
+
+// ParseTemplate parses the webhook payload template file at path. Besides the
+// fields of Update, the template has access to a json function which encodes
+// its argument as JSON, e.g.
+//
+//	{"text": {{json .URL.String}}}
+func ParseTemplate(path string) (t *template.Template, err error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	t, err = template.New(path).Funcs(funcs).Parse(string(buf))
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return t, nil
+}
+
+// funcs are the functions available to payload templates.
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		buf, err := json.Marshal(v)
+		return string(buf), err
+	},
+}
+
+// defaultClient is used by webhooks without a client.
+var defaultClient = &http.Client{Timeout: settings.TimeoutDuration}
+
+// payload is the default JSON payload of webhooks.
+type payload struct {
+	URL      string            `json:"url"`
+	Name     string            `json:"name"`
+	Time     time.Time         `json:"time"`
+	Distance float64           `json:"distance"`
+	Diff     string            `json:"diff"`
+	Fields   map[string]string `json:"fields,omitempty"`
+
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// retrying tracks the failed deliveries which are retried in the background.
+var retrying sync.WaitGroup
+
+// Notify POSTs the payload of the update to the webhook URL. A failed delivery
+// is retried in the background with an exponential backoff, so a dead endpoint
+// doesn't hold up the check of the page, and its outcome is logged. The error
+// of the first attempt is returned either way.
+func (w *Webhook) Notify(up *Update) (err error) {
+	body, err := w.payload(up)
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	err = w.post(body)
+	if err == nil {
+		return nil
+	}
+	if w.Retries <= 0 {
+		return errutil.NewNoPosf("webhook: delivery to %s failed: %v", w.URL, err)
+	}
+	retrying.Add(1)
+	go func() {
+		defer retrying.Done()
+		w.retry(body)
+	}()
+	return errutil.NewNoPosf("webhook: delivery to %s failed; retrying in the background: %v", w.URL, err)
+}
+
+// retry retries a failed delivery of body with an exponential backoff.
+func (w *Webhook) retry(body []byte) {
+	var err error
+	delay := w.RetryDelay
+	for try := 1; try <= w.Retries; try++ {
+		time.Sleep(delay)
+		delay *= 2
+		err = w.post(body)
+		if err == nil {
+			slog.Info("webhook delivered", "url", w.URL, "retries", try)
+			return
+		}
+	}
+	slog.Error("webhook delivery failed", "url", w.URL, "retries", w.Retries, "err", err)
+}
+
+// payload renders the payload of the update.
+func (w *Webhook) payload(up *Update) (body []byte, err error) {
+	if w.Template == nil {
+		return json.Marshal(payload{
+			URL:      up.URL.String(),
+			Name:     up.Name,
+			Time:     up.Time,
+			Distance: up.Distance,
+			Diff:     up.Diff,
+			Fields:   up.Fields,
+
+			Suppressed: up.Suppressed,
+		})
+	}
+
+	buf := new(bytes.Buffer)
+	err = w.Template.Execute(buf, up)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// post makes a single delivery attempt of body.
+func (w *Webhook) post(body []byte) (err error) {
+	client := w.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errutil.Err(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	// If response contained a client or server error, fail with that error.
+	if resp.StatusCode >= 400 {
+		return errutil.NewNoPosf("%s: %s", w.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a local webhook receiver which fails the first fails requests.
+type receiver struct {
+	sync.Mutex
+	fails  int
+	bodies []string
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.fails > 0 {
+		rc.fails--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	buf, _ := ioutil.ReadAll(r.Body)
+	rc.bodies = append(rc.bodies, string(buf))
+}
+
+func testUpdate(t *testing.T) *Update {
+	u, err := url.Parse("http://example.org/news")
+	if err != nil {
+		t.Fatal("url.Parse:", err)
+	}
+	return &Update{
+		URL:      u,
+		Name:     "news",
+		Time:     time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+		Distance: 12.5,
+		Diff:     "-old\n+new\n",
+		Fields:   map[string]string{"price": "1299"},
+	}
+}
+
+func TestWebhookDefaultPayload(t *testing.T) {
+	rc := new(receiver)
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	w := &Webhook{URL: srv.URL}
+	err := w.Notify(testUpdate(t))
+	if err != nil {
+		t.Fatal("Notify:", err)
+	}
+	if len(rc.bodies) != 1 {
+		t.Fatalf("received %d payloads != expected 1", len(rc.bodies))
+	}
+
+	var got payload
+	err = json.Unmarshal([]byte(rc.bodies[0]), &got)
+	if err != nil {
+		t.Fatal("json.Unmarshal:", err)
+	}
+	want := payload{
+		URL:      "http://example.org/news",
+		Name:     "news",
+		Time:     time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+		Distance: 12.5,
+		Diff:     "-old\n+new\n",
+		Fields:   map[string]string{"price": "1299"},
+	}
+	if got.URL != want.URL || got.Name != want.Name || !got.Time.Equal(want.Time) ||
+		got.Distance != want.Distance || got.Diff != want.Diff || got.Fields["price"] != want.Fields["price"] {
+		t.Errorf("output %#v != expected %#v", got, want)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	rc := new(receiver)
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "nyfiken")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "payload.tmpl")
+	err = ioutil.WriteFile(path, []byte(`{"text": {{json (printf "%s was updated: %s" .Name .Fields.price)}}}`), 0600)
+	if err != nil {
+		t.Fatal("ioutil.WriteFile:", err)
+	}
+
+	tmpl, err := ParseTemplate(path)
+	if err != nil {
+		t.Fatal("ParseTemplate:", err)
+	}
+	w := NewWebhook(srv.URL, tmpl, 0)
+	err = w.Notify(testUpdate(t))
+	if err != nil {
+		t.Fatal("Notify:", err)
+	}
+
+	want := `{"text": "news was updated: 1299"}`
+	if len(rc.bodies) != 1 || rc.bodies[0] != want {
+		t.Errorf("output %q != expected %q", rc.bodies, want)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	var golden = []struct {
+		fails   int
+		retries int
+		ok      bool
+	}{
+		{fails: 2, retries: 3, ok: true},
+		{fails: 3, retries: 3, ok: true},
+		{fails: 4, retries: 3, ok: false},
+		{fails: 1, retries: 0, ok: false},
+	}
+
+	for _, g := range golden {
+		rc := &receiver{fails: g.fails}
+		srv := httptest.NewServer(rc)
+
+		// The first attempt fails, and the retries run in the background.
+		w := &Webhook{URL: srv.URL, Retries: g.retries, RetryDelay: time.Millisecond}
+		err := w.Notify(testUpdate(t))
+		if err == nil {
+			t.Errorf("fails %d, retries %d: expected error of the first attempt, got nil", g.fails, g.retries)
+		}
+		retrying.Wait()
+		srv.Close()
+		if ok := len(rc.bodies) == 1; ok != g.ok {
+			t.Errorf("fails %d, retries %d: delivered %v != expected %v", g.fails, g.retries, ok, g.ok)
+		}
+	}
+}
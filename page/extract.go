@@ -0,0 +1,115 @@
+package page
+
+import (
+	"strings"
+
+	"code.google.com/p/cascadia"
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+	"github.com/mewkiz/pkg/htmlutil"
+	"golang.org/x/net/html"
+)
+
+// selectNodes returns all nodes in the tree rooted at htmlNode which matches
+// the CSS selector string sel. The whole tree is returned if sel is empty.
+func selectNodes(htmlNode *html.Node, sel string) (nodes []*html.Node, err error) {
+	if sel == "" {
+		return []*html.Node{htmlNode}, nil
+	}
+
+	// Make a selector from the user specified string.
+	s, err := cascadia.Compile(sel)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+
+	// Find all nodes that matches selection s.
+	return s.MatchAll(htmlNode), nil
+}
+
+// extract renders nodes to a string as specified by the extraction mode; the
+// full HTML (default), the normalised visible text or the value of an
+// attribute. Text and attribute values are separated by newlines.
+func extract(nodes []*html.Node, mode string) (s string, err error) {
+	switch {
+	case mode == "" || mode == settings.ExtractHTML:
+		for _, node := range nodes {
+			h, err := htmlutil.RenderClean(node)
+			if err != nil {
+				return "", errutil.Err(err)
+			}
+			s += h
+		}
+	case mode == settings.ExtractText:
+		for _, node := range nodes {
+			if text := visibleText(node); text != "" {
+				s += text + settings.Newline
+			}
+		}
+	case strings.HasPrefix(mode, settings.ExtractAttrPrefix):
+		key := mode[len(settings.ExtractAttrPrefix):]
+		for _, node := range nodes {
+			for _, attr := range node.Attr {
+				if attr.Key == key {
+					s += attr.Val + settings.Newline
+					break
+				}
+			}
+		}
+	default:
+		return "", errutil.NewNoPosf("invalid extraction mode: `%s`", mode)
+	}
+	return s, nil
+}
+
+// visibleText returns the text of node and its descendants with whitespace
+// collapsed. The contents of elements which aren't displayed are ignored.
+func visibleText(node *html.Node) string {
+	var words []string
+	var f func(node *html.Node)
+	f = func(node *html.Node) {
+		switch {
+		case node.Type == html.TextNode:
+			words = append(words, strings.Fields(node.Data)...)
+		case node.Type == html.ElementNode && hidden[node.Data]:
+			return
+		}
+
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(node)
+	return strings.Join(words, " ")
+}
+
+// hidden is a set of elements whose contents are never displayed.
+var hidden = map[string]bool{
+	"head":     true,
+	"noscript": true,
+	"script":   true,
+	"style":    true,
+	"template": true,
+}
+
+// extractFields returns the values of the named fields of the page, extracted
+// from the tree rooted at htmlNode.
+func (p *Page) extractFields(htmlNode *html.Node) (fields map[string]string, err error) {
+	if len(p.Settings.Fields) == 0 {
+		return nil, nil
+	}
+
+	fields = make(map[string]string)
+	for _, field := range p.Settings.Fields {
+		nodes, err := selectNodes(htmlNode, field.Selection)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		value, err := extract(nodes, field.Extract)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		fields[field.Name] = strings.TrimSpace(value)
+	}
+	return fields, nil
+}
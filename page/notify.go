@@ -0,0 +1,210 @@
+package page
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"time"
+
+	"github.com/karlek/nyfiken/diff"
+	"github.com/karlek/nyfiken/filename"
+	"github.com/karlek/nyfiken/history"
+	"github.com/karlek/nyfiken/metrics"
+	"github.com/karlek/nyfiken/notify"
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+	"golang.org/x/net/html"
+)
+
+// Name returns the name of the page used in notifications, which defaults to
+// the host of its URL.
+func (p *Page) Name() string {
+	if p.Settings.Name != "" {
+		return p.Settings.Name
+	}
+	return p.ReqUrl.Host
+}
+
+// notifiers returns the notifiers which should be notified when the page has
+// been updated. The notification targets of the page replace its mail, webhook
+// and update command.
+func (p *Page) notifiers() (ns []notify.Notifier, err error) {
+	global := settings.Global()
+
+	// Notify the named notification targets of the page.
+	if len(p.Settings.Notify) > 0 {
+		for _, name := range p.Settings.Notify {
+			t, found := global.Targets[name]
+			if !found {
+				return nil, errutil.NewNoPosf("page: unknown notification target `%s`", name)
+			}
+			tns, err := notify.FromTarget(t)
+			if err != nil {
+				return nil, errutil.Err(err)
+			}
+			ns = append(ns, tns...)
+		}
+		return ns, nil
+	}
+
+	// If the page has a mail and all compulsory global mail settings are set,
+	// send a mail to notify the user about an update.
+	if p.Settings.RecvMail != "" &&
+		global.SenderMail.OutServer != "" &&
+		global.SenderMail.Address != "" {
+		ns = append(ns, &notify.Mail{To: p.Settings.RecvMail})
+	}
+
+	// If the page has a webhook, post a notification to it.
+	if p.Settings.Webhook != "" {
+		ns = append(ns, notify.NewWebhook(
+			p.Settings.Webhook,
+			global.Webhook.Payload,
+			global.Webhook.Retries,
+		))
+	}
+
+	// If the page has an update command, run it.
+	if p.Settings.OnUpdate != "" {
+		ns = append(ns, &notify.Command{
+			Command: p.Settings.OnUpdate,
+			Timeout: global.OnUpdateTimeout,
+		})
+	}
+
+	return ns, nil
+}
+
+// newUpdate returns a description of an update of the page, where doc is the
+// downloaded page, debug is its full HTML, cachePathName is the path to the
+// cached selection and old and new are the previous and current selections.
+func (p *Page) newUpdate(doc *html.Node, debug, cachePathName, old, new string, dist float64) (up *notify.Update, err error) {
+	// Describe the update with the selection without the stripping functions,
+	// since their only purpose is to remove false-positives. It will make the
+	// output look better. Excluded subtrees are still removed, so the reader
+	// doesn't see them either.
+	contentPage := Page{p.ReqUrl, p.Settings}
+	contentPage.Settings.StripFuncs = nil
+	contentPage.Settings.Regexps = nil
+	content, err := contentPage.makeSelection(doc)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+
+	fields, err := p.extractFields(doc)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+
+	up = &notify.Update{
+		URL:      p.ReqUrl,
+		Name:     p.Name(),
+		Time:     time.Now(),
+		Distance: dist,
+		Diff:     diff.Lines(old, new),
+		Content:  content,
+		Fields:   fields,
+
+		CacheFile: cachePathName,
+		Snapshot:  debug,
+	}
+	return up, nil
+}
+
+// notify notifies the notifiers of the page about the update. A notifier which
+// fails is logged, and doesn't keep the others from being notified.
+func (p *Page) notify(up *notify.Update) (err error) {
+	ns, err := p.notifiers()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	if len(ns) == 0 {
+		return nil
+	}
+
+	var notified, delivered bool
+	for _, n := range ns {
+		err = n.Notify(up)
+		if err != nil {
+			metrics.NotificationFailures.Inc(p.labels()...)
+			p.logger().Error("notification failed", "notifier", fmt.Sprintf("%T", n), "err", err)
+			continue
+		}
+		metrics.Notifications.Inc(p.labels()...)
+		notified = true
+		// An update which was only added to a digest hasn't been delivered
+		// yet.
+		if m, ok := n.(*notify.Mail); ok && m.Digested() {
+			continue
+		}
+		delivered = true
+	}
+
+	// The unread updates are independent of notifications, unless the page
+	// should be marked as read once a notification has been delivered.
+	if delivered && p.Settings.MarkRead {
+		settings.DelUpdate(p.ReqUrl.String())
+	}
+
+	if notified {
+		p.logger().Info("notified")
+	}
+	return nil
+}
+
+// Summarize notifies the summaries of suppressed notifications which are due at
+// now. A page which fails to be summarized is logged, and doesn't keep the
+// others from being summarized.
+func Summarize(now time.Time) (err error) {
+	ss, err := history.Summaries(now)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	for _, s := range ss {
+		p := Lookup(s.URL)
+		if p == nil {
+			continue
+		}
+		err = p.summarize(s, now)
+		if err != nil {
+			p.logger().Error("unable to summarize suppressed notifications", "err", err)
+		}
+	}
+	return nil
+}
+
+// summarize notifies a summary of the suppressed notifications of the page,
+// with its current selection as content.
+func (p *Page) summarize(s history.Summary, now time.Time) (err error) {
+	linuxPath, err := filename.Encode(p.UrlAsFilename())
+	if err != nil {
+		return errutil.Err(err)
+	}
+	cachePathName := settings.CacheRoot + linuxPath + ".htm"
+	buf, err := ioutil.ReadFile(cachePathName)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	up := &notify.Update{
+		URL:     p.ReqUrl,
+		Name:    p.Name(),
+		Time:    now,
+		Content: string(buf),
+
+		CacheFile:  cachePathName,
+		Suppressed: s.Suppressed,
+	}
+	p.logger().Info("summarizing suppressed notifications", "suppressed", s.Suppressed, "since", s.Since)
+	return p.notify(up)
+}
+
+// RunSummaries notifies due summaries of suppressed notifications every
+// minute.
+func RunSummaries() {
+	for now := range time.Tick(time.Minute) {
+		err := Summarize(now)
+		if err != nil {
+			slog.Error("unable to summarize suppressed notifications", "err", err)
+		}
+	}
+}
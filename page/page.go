@@ -2,22 +2,27 @@
 package page
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/cascadia"
 	"code.google.com/p/mahonia"
 	"github.com/karlek/nyfiken/distance"
+	"github.com/karlek/nyfiken/feed"
 	"github.com/karlek/nyfiken/filename"
-	"github.com/karlek/nyfiken/mail"
+	"github.com/karlek/nyfiken/history"
+	"github.com/karlek/nyfiken/metrics"
 	"github.com/karlek/nyfiken/settings"
 	"github.com/karlek/nyfiken/strip"
 	"github.com/mewkiz/pkg/errutil"
@@ -64,7 +69,44 @@ func (p *Page) UrlAsFilename() string {
 // saved on disk to determine if the page has been updated. Check takes
 // an error channel to concurrently handle errors.
 func (p *Page) Check(ch chan<- error) {
-	ch <- p.check()
+	start := time.Now()
+	err := p.check()
+	p.setChecked(start, err)
+	metrics.Checks.Inc(p.labels()...)
+	if err != nil {
+		kind := metrics.FailOther
+		if f, ok := err.(*failure); ok {
+			kind = f.kind
+		}
+		metrics.CheckFailures.Inc(p.labels(kind)...)
+		p.logger().Error("check failed", "kind", kind, "err", err)
+	}
+	ch <- err
+}
+
+// logger returns a logger with the page as context.
+func (p *Page) logger() *slog.Logger {
+	return slog.With("page", p.ReqUrl.String())
+}
+
+// labels returns the metric labels of the page; its URL and host.
+func (p *Page) labels(extra ...string) []string {
+	return append([]string{p.ReqUrl.String(), p.ReqUrl.Host}, extra...)
+}
+
+// failure is an error of a check with a known kind of failure.
+type failure struct {
+	kind string
+	err  error
+}
+
+func (f *failure) Error() string {
+	return f.err.Error()
+}
+
+// fail returns err as a failure of the kind.
+func fail(kind string, err error) error {
+	return &failure{kind: kind, err: err}
 }
 
 // NOTE: The check function implements a lot of functionality and is massive
@@ -75,9 +117,7 @@ func (p *Page) Check(ch chan<- error) {
 
 // check is an non-exported function for better error handling.
 func (p *Page) check() (err error) {
-	if settings.Verbose {
-		fmt.Println("[/] Downloading:", p.ReqUrl.String())
-	}
+	p.logger().Debug("downloading")
 
 	// NOTE: Use embedding to propagate methods of a given struct member, not to
 	// save key strokes. As *html.Node and error are embedded members of r the
@@ -92,13 +132,29 @@ func (p *Page) check() (err error) {
 		error
 	}
 	// NOTE: Ideomatic use of select and time.After for timeouts, nice :)
+	start := time.Now()
 	select {
 	case r = <-errWrapDownload(p):
+		metrics.FetchDuration.Observe(time.Since(start).Seconds(), p.labels()...)
 		if r.error != nil {
-			return errutil.Err(r.error)
+			if _, ok := r.error.(*statusError); ok {
+				return fail(metrics.FailHTTPStatus, errutil.Err(r.error))
+			}
+			if isTimeout(r.error) {
+				return fail(metrics.FailTimeout, errutil.NewNoPosf("timeout: %s: %v", p.ReqUrl, r.error))
+			}
+			return fail(metrics.FailFetch, errutil.Err(r.error))
 		}
 	case <-time.After(settings.TimeoutDuration):
-		return errutil.NewNoPosf("timeout: %s", p.ReqUrl.String())
+		metrics.FetchDuration.Observe(time.Since(start).Seconds(), p.labels()...)
+		return fail(metrics.FailTimeout, errutil.NewNoPosf("timeout: %s", p.ReqUrl.String()))
+	}
+
+	// Debug - no selection. Rendered before the selection is made since
+	// excluded subtrees are removed from the downloaded tree.
+	debug, err := htmlutil.RenderClean(r.Node)
+	if err != nil {
+		return errutil.Err(err)
 	}
 
 	// Extract selection from downloaded source.
@@ -116,11 +172,6 @@ func (p *Page) check() (err error) {
 		return errutil.Err(err)
 	}
 
-	// Debug - no selection.
-	debug, err := htmlutil.RenderClean(r.Node)
-	if err != nil {
-		return errutil.Err(err)
-	}
 	// Update the debug comparison file.
 
 	// NOTE: Consider using filepath.Join instead of string appends. The ".htm"
@@ -129,7 +180,7 @@ func (p *Page) check() (err error) {
 	//
 	//    debugCachePathName := filepath.Join(settings.DebugCacheRoot, linuxPath + ".htm")
 	debugCachePathName := settings.DebugCacheRoot + linuxPath + ".htm"
-	err = ioutil.WriteFile(debugCachePathName, []byte(debug), settings.Global.FilePerms)
+	err = ioutil.WriteFile(debugCachePathName, []byte(debug), settings.Global().FilePerms)
 	if err != nil {
 		return errutil.Err(err)
 	}
@@ -139,7 +190,7 @@ func (p *Page) check() (err error) {
 	// If the selection is empty, the CSS selection is probably wrong so we will
 	// alert the user about this problem.
 	if len(selection) == 0 {
-		return errutil.NewNoPosf("Update was empty. URL: %s", p.ReqUrl)
+		return fail(metrics.FailEmpty, errutil.NewNoPosf("Update was empty. URL: %s", p.ReqUrl))
 	}
 
 	cachePathName := settings.CacheRoot + linuxPath + ".htm"
@@ -155,7 +206,7 @@ func (p *Page) check() (err error) {
 		err = ioutil.WriteFile(
 			cachePathName,
 			[]byte(selection),
-			settings.Global.FilePerms,
+			settings.Global().FilePerms,
 		)
 		if err != nil {
 			return errutil.Err(err)
@@ -166,7 +217,7 @@ func (p *Page) check() (err error) {
 		err = ioutil.WriteFile(
 			readPathName,
 			[]byte(selection),
-			settings.Global.FilePerms,
+			settings.Global().FilePerms,
 		)
 		if err != nil {
 			return errutil.Err(err)
@@ -175,14 +226,12 @@ func (p *Page) check() (err error) {
 		debugReadPathName := settings.DebugReadRoot + linuxPath + ".htm"
 
 		// Update the debug prev file.
-		err = ioutil.WriteFile(debugReadPathName, []byte(debug), settings.Global.FilePerms)
+		err = ioutil.WriteFile(debugReadPathName, []byte(debug), settings.Global().FilePerms)
 		if err != nil {
 			return errutil.Err(err)
 		}
 
-		if settings.Verbose {
-			fmt.Println("[+] New site added:", p.ReqUrl.String())
-		}
+		p.logger().Info("new page added")
 
 		return nil
 	}
@@ -194,51 +243,71 @@ func (p *Page) check() (err error) {
 	// match.
 	if dist > p.Settings.Threshold {
 		u := p.ReqUrl.String()
-		settings.Updates[u] = true
+		settings.AddUpdate(u)
+
+		p.logger().Info("updated", "distance", dist)
 
-		if settings.Verbose {
-			fmt.Println("[!] Updated:", p.ReqUrl.String())
+		// Update the comparison file before the notifiers run, so an update
+		// command finds the new selection in it.
+		err = ioutil.WriteFile(cachePathName, []byte(selection), settings.Global().FilePerms)
+		if err != nil {
+			return errutil.Err(err)
 		}
 
-		// If the page has a mail and all compulsory global mail settings are
-		// set, send a mail to notify the user about an update.
-		if p.Settings.RecvMail != "" &&
-			settings.Global.SenderMail.AuthServer != "" &&
-			settings.Global.SenderMail.OutServer != "" &&
-			settings.Global.SenderMail.Address != "" {
-
-			// Mail the selection without the stripping functions, since their
-			// only purpose is to remove false-positives. It will make the
-			// output look better.
-			mailPage := Page{p.ReqUrl, p.Settings}
-			mailPage.Settings.StripFuncs = nil
-			mailPage.Settings.Regexp = ""
-			sel, err := mailPage.makeSelection(r.Node)
-			if err != nil {
-				return errutil.Err(err)
-			}
+		up, err := p.newUpdate(r.Node, debug, cachePathName, string(buf), selection, dist)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		p.setUpdated(up.Time)
+		metrics.Updates.Inc(p.labels()...)
 
-			err = mail.Send(p.ReqUrl, p.Settings.RecvMail, sel)
-			if err != nil {
-				return errutil.Err(err)
-			}
-			delete(settings.Updates, u)
+		// Record the update in the feed.
+		content := up.Diff
+		if content == "" {
+			content = up.Content
 		}
-		// Save updates to file.
-		err = settings.SaveUpdates()
+		err = feed.Add(feed.Entry{
+			URL:     u,
+			Name:    up.Name,
+			Time:    up.Time,
+			Content: content,
+			Tags:    p.Settings.Tags,
+		})
 		if err != nil {
 			return errutil.Err(err)
 		}
 
-		// Update the comparison file.
-		err = ioutil.WriteFile(cachePathName, []byte(selection), settings.Global.FilePerms)
+		// Notify the user about the update, unless the page is flapping or
+		// the rate limit of notifications has been reached.
+		limits := history.Limits{
+			Snapshots: p.Settings.FlapLimit,
+			Rate:      p.Settings.RateLimit,
+			Window:    p.Settings.RateWindow,
+		}
+		ok, suppressed, err := history.Check(u, string(buf), selection, up.Time, limits)
 		if err != nil {
 			return errutil.Err(err)
 		}
-	} else {
-		if settings.Verbose {
-			fmt.Println("[-] No update:", p.ReqUrl.String())
+		if ok {
+			up.Suppressed = suppressed
+			// The update is saved even if the notifiers fail, since it
+			// would otherwise be detected and notified again on the next
+			// check.
+			err = p.notify(up)
+			if err != nil {
+				p.logger().Error("unable to notify", "err", err)
+			}
+		} else {
+			p.logger().Info("notification suppressed")
+		}
+
+		// Save updates to file.
+		err = settings.SaveUpdates()
+		if err != nil {
+			return errutil.Err(err)
 		}
+	} else {
+		p.logger().Debug("no update", "distance", dist)
 	}
 	return nil
 }
@@ -254,12 +323,14 @@ func errWrapDownload(p *Page) <-chan struct {
 	*html.Node
 	error
 } {
-	doc, err := p.download()
+	// The channel is buffered so the download doesn't block forever if the
+	// check has timed out.
 	result := make(chan struct {
 		*html.Node
 		error
-	})
+	}, 1)
 	go func() {
+		doc, err := p.download()
 		result <- struct {
 			*html.Node
 			error
@@ -268,6 +339,20 @@ func errWrapDownload(p *Page) <-chan struct {
 	return result
 }
 
+// client downloads the pages. Its timeout also covers reading the response
+// body, so a stalled server can't keep a download running after the check
+// has timed out.
+var client = &http.Client{Timeout: settings.TimeoutDuration}
+
+// isTimeout reports whether the download failed because it timed out.
+func isTimeout(err error) bool {
+	if e, ok := err.(*errutil.ErrInfo); ok {
+		err = e.Err
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
 // Download the page with or without user specified headers.
 func (p *Page) download() (doc *html.Node, err error) {
 
@@ -287,7 +372,7 @@ func (p *Page) download() (doc *html.Node, err error) {
 	}
 
 	// Do request and read response.
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		if serr, ok := err.(*url.Error); ok {
 			if serr.Err == io.EOF {
@@ -300,7 +385,7 @@ func (p *Page) download() (doc *html.Node, err error) {
 
 	// If response contained a client or server error, fail with that error.
 	if resp.StatusCode >= 400 {
-		return nil, errutil.Newf("%s: (%d) - %s", p.ReqUrl.String(), resp.StatusCode, resp.Status)
+		return nil, &statusError{url: p.ReqUrl.String(), code: resp.StatusCode, status: resp.Status}
 	}
 
 	// Read the response body to []byte.
@@ -340,66 +425,62 @@ func (p *Page) download() (doc *html.Node, err error) {
 // Right now you are using --- [ foo ] --- to separate the functionality, so
 // split it instead.
 
+// statusError is the error of a response with a client or server error.
+type statusError struct {
+	url    string
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: (%d) - %s", e.url, e.code, e.status)
+}
+
 // Select from the retrived page source the CSS selection defined in c4c.ini.
 func (p *Page) makeSelection(htmlNode *html.Node) (selection string, err error) {
 
-	// --- [ CSS selection ] --------------------------------------------------/
+	// --- [ Exclude ] --------------------------------------------------------/
 
-	// Write results into an array of nodes.
-	var result []*html.Node
+	err = p.exclude(htmlNode)
+	if err != nil {
+		return "", errutil.Err(err)
+	}
 
-	// Append the whole page (htmlNode) to results if no selector where chosen.
-	if p.Settings.Selection == "" {
-		result = append(result, htmlNode)
-	} else {
+	// --- [ /Exclude ] -------------------------------------------------------/
 
-		// Make a selector from the user specified string.
-		s, err := cascadia.Compile(p.Settings.Selection)
-		if err != nil {
-			return "", errutil.Err(err)
-		}
+	// --- [ CSS selection ] --------------------------------------------------/
 
-		// Find all nodes that matches selection s.
-		result = s.MatchAll(htmlNode)
+	result, err := selectNodes(htmlNode, p.Settings.Selection)
+	if err != nil {
+		return "", errutil.Err(err)
 	}
 
-	// Loop through all the hits and render them to string.
-	for _, hit := range result {
-		s, err := htmlutil.RenderClean(hit)
-		if err != nil {
-			return "", errutil.Err(err)
-		}
-		selection += s
+	// Render the hits to string as specified by the extraction mode.
+	selection, err = extract(result, p.Settings.Extract)
+	if err != nil {
+		return "", errutil.Err(err)
 	}
 
 	// --- [ /CSS selection ] -------------------------------------------------/
 
 	// --- [ Strip funcs ] ----------------------------------------------------/
 
-	for _, stripFunc := range p.Settings.StripFuncs {
+	// The order of the strip functions defines the order of the pipeline.
+	if len(p.Settings.StripFuncs) > 0 {
 		doc, err := html.Parse(strings.NewReader(selection))
 		if err != nil {
 			return "", errutil.Err(err)
 		}
-		// NOTE: This is one of the features I enjoy the most with nyfiken! The
-		// strip functions are simply great. Consider adding a default case which
-		// catches invalid or misspelled strip functions. I know that the
-		// nyfiken/ini package already takes care of this, but a future version of
-		// nyfiken may replace the configuration implementation and forget this
-		// check. In general, use defence in depth when checking for errors. I
-		// know this is a silly example but the principle is the same.
-		stripFunc = strings.ToLower(stripFunc)
-		switch stripFunc {
-		case "numbers":
-			strip.Numbers(doc)
-		case "attrs":
-			strip.Attrs(doc)
-		case "html":
-			strip.HTML(doc)
-		case "scripts":
-			strip.Scripts(doc)
+		for _, stripFunc := range p.Settings.StripFuncs {
+			t, err := strip.Lookup(stripFunc)
+			if err != nil {
+				return "", errutil.Err(err)
+			}
+			err = t.Transform(doc)
+			if err != nil {
+				return "", errutil.Err(err)
+			}
 		}
-
 		selection, err = htmlutil.RenderClean(doc)
 		if err != nil {
 			return "", errutil.Err(err)
@@ -410,33 +491,42 @@ func (p *Page) makeSelection(htmlNode *html.Node) (selection string, err error)
 
 	// --- [ Regexp ] ---------------------------------------------------------/
 
-	if p.Settings.Regexp != "" {
-		re, err := regexp.Compile(p.Settings.Regexp)
+	for _, expr := range p.Settings.Regexps {
+		re, err := regexp.Compile(expr.Pattern)
 		if err != nil {
 			return "", errutil.Err(err)
 		}
 
+		// Keep whole matches unless a template was specified.
+		template := expr.Template
+		if template == "" {
+			template = "$0"
+		}
+
 		// -1 means to find all.
-		result := re.FindAllString(selection, -1)
+		matches := re.FindAllStringSubmatchIndex(selection, -1)
 
-		selection = ""
-		for _, res := range result {
-			selection += res + settings.Newline
+		var buf []byte
+		for _, match := range matches {
+			buf = re.ExpandString(buf, template, selection, match)
+			buf = append(buf, settings.Newline...)
 		}
+		selection = string(buf)
 	}
 
 	// --- [ /Regexp ] --------------------------------------------------------/
 
 	// --- [ Negexp ] ---------------------------------------------------------/
 
-	if p.Settings.Negexp != "" {
-		ne, err := regexp.Compile(p.Settings.Negexp)
+	for _, expr := range p.Settings.Negexps {
+		ne, err := regexp.Compile(expr.Pattern)
 		if err != nil {
 			return "", errutil.Err(err)
 		}
 
-		// Remove all that matches the regular expression ne
-		selection = ne.ReplaceAllString(selection, "")
+		// Replace all that matches the regular expression ne with the
+		// template, which is empty unless specified.
+		selection = ne.ReplaceAllString(selection, expr.Template)
 	}
 
 	// --- [ /Negexp ] --------------------------------------------------------/
@@ -444,8 +534,42 @@ func (p *Page) makeSelection(htmlNode *html.Node) (selection string, err error)
 	return selection, nil
 }
 
+// exclude removes all nodes matching the user specified exclude selectors from
+// the tree rooted at htmlNode.
+func (p *Page) exclude(htmlNode *html.Node) (err error) {
+	for _, sel := range p.Settings.Exclude {
+		s, err := cascadia.Compile(sel)
+		if err != nil {
+			return errutil.Err(err)
+		}
+
+		// Nodes without a parent have either been removed already or are the
+		// root of the tree.
+		for _, node := range s.MatchAll(htmlNode) {
+			if node.Parent != nil {
+				node.Parent.RemoveChild(node)
+			}
+		}
+	}
+	return nil
+}
+
+// checks are the in-flight checks, and stopped is set once no new checks may
+// be started.
+var (
+	checks    sync.WaitGroup
+	stoppedMu sync.Mutex
+	stopped   bool
+)
+
 // Check all pages immediately
 func ForceUpdate(pages []*Page) (err error) {
+	stoppedMu.Lock()
+	defer stoppedMu.Unlock()
+	if stopped {
+		return nil
+	}
+
 	// A channel in which errors are sent from p.Check()
 	errChan := make(chan error)
 
@@ -453,18 +577,41 @@ func ForceUpdate(pages []*Page) (err error) {
 	var numChecks int
 	for _, p := range pages {
 		// Start a go-routine to check if the page has been updated.
-		go p.Check(errChan)
+		checks.Add(1)
+		go func(p *Page) {
+			defer checks.Done()
+			p.Check(errChan)
+		}(p)
 		numChecks++
 	}
 
-	// For each check that took place, listen if any check returned an error
+	// Wait for each check that took place. Errors are logged by Check with the
+	// page as context.
 	go func(ch chan error, nChecks int) {
 		for i := 0; i < nChecks; i++ {
-			if err := <-ch; err != nil {
-				log.Println(errutil.Err(err))
-			}
+			<-ch
 		}
 	}(errChan, numChecks)
 
 	return nil
 }
+
+// Stop stops new checks from being started and waits for the in-flight checks
+// to finish, at most for the timeout. It reports whether all checks finished.
+func Stop(timeout time.Duration) bool {
+	stoppedMu.Lock()
+	stopped = true
+	stoppedMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		checks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,114 @@
+package page
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karlek/nyfiken/metrics"
+	"github.com/karlek/nyfiken/settings"
+)
+
+func TestCheckTimeout(t *testing.T) {
+	// The server sends the headers and then stalls in the middle of the body.
+	stop := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><body>"))
+		w.(http.Flusher).Flush()
+		<-stop
+	}))
+	defer ts.Close()
+	defer close(stop)
+
+	defer func(c *http.Client) { client = c }(client)
+	client = &http.Client{Timeout: 100 * time.Millisecond}
+
+	u, err := url.Parse(ts.URL + "/stalled")
+	if err != nil {
+		t.Fatal("url.Parse:", err)
+	}
+	p := &Page{ReqUrl: u}
+	ch := make(chan error, 1)
+	go p.Check(ch)
+
+	select {
+	case err = <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("check of stalled page didn't time out")
+	}
+	if err == nil {
+		t.Fatal("expected timeout error, got nil")
+	}
+	if got := metrics.CheckFailures.Value(p.labels(metrics.FailTimeout)...); got != 1 {
+		t.Errorf("expected 1 timeout failure, got %v", got)
+	}
+	if s := StatusOf(u.String()); s.Err == "" {
+		t.Error("expected the timeout to be recorded in the status")
+	}
+}
+
+func TestCheckCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-page")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.UpdatesPath = filepath.Join(dir, "updates.gob")
+	settings.FeedPath = filepath.Join(dir, "feed.gob")
+	settings.HistoryPath = filepath.Join(dir, "history.gob")
+	settings.CacheRoot = dir + "/cache/"
+	settings.ReadRoot = dir + "/read/"
+	settings.DebugCacheRoot = dir + "/debug/cache/"
+	settings.DebugReadRoot = dir + "/debug/read/"
+	for _, root := range []string{settings.CacheRoot, settings.ReadRoot, settings.DebugCacheRoot, settings.DebugReadRoot} {
+		os.MkdirAll(root, 0755)
+	}
+
+	var mu sync.Mutex
+	body := "<p>old</p>"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	// The update command records the cached selection it's given.
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "on_update.sh")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\ncat \"$NYFIKEN_CACHE_FILE\" > "+out+"\n"), 0700)
+	if err != nil {
+		t.Fatal("ioutil.WriteFile:", err)
+	}
+
+	u, err := url.Parse(ts.URL + "/cache")
+	if err != nil {
+		t.Fatal("url.Parse:", err)
+	}
+	p := &Page{ReqUrl: u, Settings: settings.Page{OnUpdate: script}}
+	for _, b := range []string{"<p>old</p>", "<p>new</p>"} {
+		mu.Lock()
+		body = b
+		mu.Unlock()
+		ch := make(chan error, 1)
+		p.Check(ch)
+		if err := <-ch; err != nil {
+			t.Fatal("Check:", err)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal("ioutil.ReadFile:", err)
+	}
+	if got := string(buf); !strings.Contains(got, "new") {
+		t.Errorf("expected the update command to get the new selection, got %q", got)
+	}
+}
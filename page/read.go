@@ -0,0 +1,70 @@
+package page
+
+import (
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/karlek/nyfiken/filename"
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// MarkRead marks the update of the page with the URL as read; the cached
+// snapshots are copied to the read snapshots, which later diffs are made
+// against. The updates must be saved by the caller.
+func MarkRead(rawurl string) (err error) {
+	settings.DelUpdate(rawurl)
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	p := Page{ReqUrl: u}
+	fname, err := filename.Encode(p.UrlAsFilename())
+	if err != nil {
+		return errutil.Err(err)
+	}
+	err = copyFile(settings.ReadRoot+fname+".htm", settings.CacheRoot+fname+".htm")
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return copyFile(settings.DebugReadRoot+fname+".htm", settings.DebugCacheRoot+fname+".htm")
+}
+
+// MarkAllRead marks all updates as read. The updates must be saved by the
+// caller.
+func MarkAllRead() (err error) {
+	for u := range settings.Updates() {
+		err = MarkRead(u)
+		if err != nil {
+			return errutil.Err(err)
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file at src to dst. A missing source file is ignored.
+func copyFile(dst, src string) (err error) {
+	sf, err := os.Open(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errutil.Err(err)
+	}
+	defer sf.Close()
+	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, settings.Global().FilePerms)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	_, err = io.Copy(df, sf)
+	if err != nil {
+		df.Close()
+		return errutil.Err(err)
+	}
+	err = df.Close()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package page
+
+import (
+	"sync"
+	"time"
+
+	"github.com/karlek/nyfiken/metrics"
+)
+
+// Status is the outcome of the recent checks of a page.
+type Status struct {
+	Checked time.Time // Time of the last check.
+	Updated time.Time // Time of the last detected update.
+	Err     string    // Error of the last check; empty if it succeeded.
+}
+
+// pages are the checked pages and statuses their statuses by URL.
+var (
+	mu       sync.RWMutex
+	pages    []*Page
+	statuses = make(map[string]Status)
+)
+
+// SetPages sets the pages which are checked by nyfikend.
+func SetPages(ps []*Page) {
+	mu.Lock()
+	defer mu.Unlock()
+	pages = ps
+	metrics.Pages.Set(float64(len(ps)))
+}
+
+// Pages returns the pages which are checked by nyfikend.
+func Pages() []*Page {
+	mu.RLock()
+	defer mu.RUnlock()
+	return pages
+}
+
+// Lookup returns the checked page with the URL, or nil if there is none.
+func Lookup(rawurl string) *Page {
+	for _, p := range Pages() {
+		if p.ReqUrl.String() == rawurl {
+			return p
+		}
+	}
+	return nil
+}
+
+// StatusOf returns the status of the page with the URL.
+func StatusOf(rawurl string) Status {
+	mu.RLock()
+	defer mu.RUnlock()
+	return statuses[rawurl]
+}
+
+// setChecked records the outcome of a check of the page.
+func (p *Page) setChecked(t time.Time, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	u := p.ReqUrl.String()
+	s := statuses[u]
+	s.Checked, s.Err = t, ""
+	if err != nil {
+		s.Err = err.Error()
+	}
+	statuses[u] = s
+}
+
+// setUpdated records that an update of the page was detected.
+func (p *Page) setUpdated(t time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	u := p.ReqUrl.String()
+	s := statuses[u]
+	s.Updated = t
+	statuses[u] = s
+}
@@ -0,0 +1,81 @@
+// Package secret resolves references to secrets which are kept outside of the
+// configuration files, e.g. in environment variables, files or password
+// managers.
+package secret
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Prefixes of secret references.
+const (
+	PrefixEnv  = "env:"  // Value of an environment variable, e.g. "env:NYFIKEN_PASS".
+	PrefixFile = "file:" // Contents of a file, e.g. "file:/home/user/.nyfiken-pass".
+	PrefixCmd  = "cmd:"  // First line of the output of a command, e.g. "cmd:pass show nyfiken".
+)
+
+// IsRef reports whether s is a reference to a secret rather than a literal
+// value.
+func IsRef(s string) bool {
+	return strings.HasPrefix(s, PrefixEnv) ||
+		strings.HasPrefix(s, PrefixFile) ||
+		strings.HasPrefix(s, PrefixCmd)
+}
+
+// Resolve returns the secret which s refers to. Values which aren't references
+// are returned as is.
+func Resolve(s string) (secret string, err error) {
+	switch {
+	case strings.HasPrefix(s, PrefixEnv):
+		name := strings.TrimPrefix(s, PrefixEnv)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errutil.NewNoPosf("secret: environment variable `%s` not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(s, PrefixFile):
+		buf, err := ioutil.ReadFile(strings.TrimPrefix(s, PrefixFile))
+		if err != nil {
+			return "", errutil.Err(err)
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	case strings.HasPrefix(s, PrefixCmd):
+		return run(strings.TrimPrefix(s, PrefixCmd))
+	}
+	return s, nil
+}
+
+// run runs a command and returns the first line of its output.
+func run(command string) (secret string, err error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errutil.NewNoPos("secret: empty command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), settings.TimeoutDuration)
+	defer cancel()
+
+	stderr := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", errutil.NewNoPosf("secret: command `%s` timed out", args[0])
+	}
+	if err != nil {
+		// Don't include the output, it may contain the secret.
+		return "", errutil.NewNoPosf("secret: command `%s` failed: %v; %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	line := string(out)
+	if i := strings.IndexAny(line, "\r\n"); i != -1 {
+		line = line[:i]
+	}
+	return line, nil
+}
@@ -0,0 +1,66 @@
+package secret
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-secret")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pass")
+	err = ioutil.WriteFile(path, []byte("from file\n"), 0600)
+	if err != nil {
+		t.Fatal("ioutil.WriteFile:", err)
+	}
+	os.Setenv("NYFIKEN_TEST_SECRET", "from env")
+	defer os.Unsetenv("NYFIKEN_TEST_SECRET")
+
+	golden := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		// i=0
+		{s: "123456", want: "123456"},
+		// i=1
+		{s: "env:NYFIKEN_TEST_SECRET", want: "from env"},
+		// i=2
+		{s: "env:NYFIKEN_TEST_UNSET", wantErr: true},
+		// i=3
+		{s: "file:" + path, want: "from file"},
+		// i=4
+		{s: "file:" + filepath.Join(dir, "missing"), wantErr: true},
+		// i=5
+		{s: "cmd:printf first\\nsecond", want: "first"},
+		// i=6
+		{s: "cmd:false", wantErr: true},
+		// i=7
+		{s: "cmd:", wantErr: true},
+	}
+
+	for i, g := range golden {
+		got, err := Resolve(g.s)
+		if g.wantErr {
+			if err == nil {
+				t.Errorf("i=%d: expected error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("i=%d: Resolve: %v", i, err)
+			continue
+		}
+		if got != g.want {
+			t.Errorf("i=%d: expected %q, got %q", i, g.want, got)
+		}
+		if IsRef(g.s) != (g.s != g.want) {
+			t.Errorf("i=%d: IsRef(%q) = %v", i, g.s, IsRef(g.s))
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package settings
+
+import (
+	"encoding/gob"
+	"log/slog"
+	"os"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// SaveGob saves v gob encoded to the file at path. It's written to a temporary
+// file which replaces the file once it's complete, so an interrupted save
+// doesn't corrupt it.
+func SaveGob(path string, v interface{}) (err error) {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	err = gob.NewEncoder(f).Encode(v)
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return errutil.Err(err)
+	}
+	err = f.Close()
+	if err != nil {
+		return errutil.Err(err)
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// LoadGob loads the gob encoded file at path into v, which should point to a
+// zero value. A missing file isn't an error, and a corrupt file is logged and
+// discarded, since the saved state is only a cache of the previous execution.
+func LoadGob(path string, v interface{}) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errutil.Err(err)
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(f).Decode(v)
+	if err != nil {
+		slog.Warn("discarding corrupt file", "path", path, "err", err)
+		return nil
+	}
+	return nil
+}
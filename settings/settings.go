@@ -2,9 +2,10 @@
 package settings
 
 import (
-	"encoding/gob"
 	"log"
 	"os"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/mewkiz/pkg/errutil"
@@ -16,6 +17,21 @@ const (
 	QueryClearAll     = "clear all!"
 	QueryForceRecheck = "recheck!"
 	QueryUpdates      = "updates?"
+	QueryAuth         = "auth " // Followed by the token.
+)
+
+// Types of notification targets.
+const (
+	TargetMail    = "mail"    // Mail to a list of addresses.
+	TargetWebhook = "webhook" // POST to an incoming webhook URL.
+	TargetCommand = "command" // Run a command.
+)
+
+// Extraction modes which specify how selected nodes are rendered.
+const (
+	ExtractHTML       = "html"  // Full HTML of the nodes.
+	ExtractText       = "text"  // Normalised visible text of the nodes.
+	ExtractAttrPrefix = "attr:" // Value of an attribute, e.g. "attr:href".
 )
 
 // Default values.
@@ -26,6 +42,19 @@ const (
 	// Duration until a timeout is issued.
 	TimeoutDuration = 10 * time.Second
 
+	// Duration to wait for in-flight checks when nyfikend is stopped.
+	ShutdownTimeout = 30 * time.Second
+
+	// Duration without further changes to the config files before they are
+	// reloaded, so a burst of writes from an editor causes a single reload.
+	ReloadDelay = 500 * time.Millisecond
+
+	// Default duration an external strip command may run before it is killed.
+	DefaultExecTimeout = 10 * time.Second
+
+	// Default duration an update command may run before it is killed.
+	DefaultOnUpdateTimeout = 1 * time.Minute
+
 	// Default permissions to create files: user read and write permissions.
 	DefaultFilePerms   = os.FileMode(0600)
 	DefaultFolderPerms = os.FileMode(0755)
@@ -33,8 +62,18 @@ const (
 	// Default newline character.
 	Newline = "\n"
 
-	// Default port number for nyfikenc/d connection.
+	// Default size at which the log file is rotated, and number of rotated log
+	// files to keep.
+	DefaultLogMaxSize = 10 << 20
+	DefaultLogBackups = 3
+
+	// Conventional port number for nyfikenc/d connection over TCP, which is
+	// only used when configured.
 	DefaultPortNum = ":5239"
+
+	// Permissions of the Unix socket for nyfikenc/d connection: user read and
+	// write permissions.
+	SocketPerms = os.FileMode(0600)
 )
 
 // NOTE: Clean use of variable declaration grouping. A single doc comment was
@@ -48,6 +87,14 @@ var (
 	CacheRoot      string
 	ReadRoot       string
 	UpdatesPath    string
+	FeedPath       string
+	DigestPath     string
+	HistoryPath    string
+	SocketPath     string
+	CertPath       string
+	KeyPath        string
+	LockPath       string
+	PidPath        string
 	DebugRoot      string
 	DebugCacheRoot string
 	DebugReadRoot  string
@@ -55,21 +102,19 @@ var (
 
 var (
 	// NOTE: Global variables may be initialized using general expressions.
-	// Therefore `Updates = make(map[string]bool)` is not required in the
+	// Therefore `updates = make(map[string]bool)` is not required in the
 	// initialize function.
 
-	// Updates is a map of all pages which have been updated.
-	Updates = make(map[string]bool)
-
-	// Settings which will be used unless overwritten by site-specific settings.
-	Global = Prog{
-		Interval:  DefaultInterval,
-		FilePerms: DefaultFilePerms,
-		PortNum:   DefaultPortNum,
-	}
+	// updates is a map of all pages which have been updated. It's shared
+	// between page checks and client connections, and guarded by updatesMu.
+	updates   = make(map[string]bool)
+	updatesMu sync.RWMutex
 
-	// When Verbose is true, enable verbose output.
-	Verbose bool
+	// global is the settings which will be used unless overwritten by
+	// site-specific settings. It's replaced as a whole when the config is
+	// reloaded, and guarded by globalMu.
+	global   *Prog
+	globalMu sync.RWMutex
 )
 
 // NOTE: Love the negexp name :)
@@ -77,14 +122,54 @@ var (
 // Page is a collection of specialized settings used to eliminate
 // false-positives. Page settings override program global settings.
 type Page struct {
+	Name       string            // Name of the page used in notifications.
 	Interval   time.Duration     // Duration of time to wait between scrapes.
 	Threshold  float64           // Percentage of accepted deviation from last scrape.
 	RecvMail   string            // Mail address to send a notification when a page has been updated.
-	Regexp     string            // Regular expression to further specify what to select.
-	Negexp     string            // Everything that matches this regular expression will be removed.
+	Webhook    string            // URL to POST a notification to when a page has been updated.
+	OnUpdate   string            // Command to run when a page has been updated.
+	Notify     []string          // Names of the notification targets of the page.
+	MarkRead   bool              // Mark the update as read once a notification has been delivered.
+	FlapLimit  int               // Number of recent snapshots which are considered flapping when seen again.
+	RateLimit  int               // Number of notifications per rate window; zero for no limit.
+	RateWindow time.Duration     // Duration of the rate limit window.
+	Tags       []string          // Tags of the page, each with its own feed.
+	Regexps    []Expr            // Regular expressions to further specify what to select, applied in order.
+	Negexps    []Expr            // Everything that matches these regular expressions will be replaced, applied in order.
 	StripFuncs []string          // Strip functions to further specify what to select.
 	Header     map[string]string // HTTP headers to request targeted site with.
 	Selection  string            // CSS selector string to specify what to select.
+	Exclude    []string          // CSS selector strings of subtrees to remove before comparison.
+	Extract    string            // Extraction mode of the selection: html, text or attr:<name>.
+	Fields     []Field           // Named values to extract from the page.
+}
+
+// Field is a named value extracted from a page, e.g. a price or a download
+// link.
+type Field struct {
+	Name      string // Name of the field.
+	Selection string // CSS selector string to specify what to select.
+	Extract   string // Extraction mode: html, text or attr:<name>.
+}
+
+// Target is a named notification target, e.g. a mailing list, a chat webhook or
+// a command.
+type Target struct {
+	Type     string             // Type of the target: mail, webhook or command.
+	To       []string           // Mail addresses of mail targets.
+	URL      string             // URL of webhook targets.
+	Template string             // Path to a text/template file of the payload of webhook targets.
+	Payload  *template.Template // Parsed payload template; nil for the default payload.
+	Retries  int                // Number of retries of failed deliveries to webhook targets.
+	Command  string             // Command of command targets.
+	Timeout  time.Duration      // Duration the command of command targets may run.
+}
+
+// Expr is a regular expression step with an optional replacement template. The
+// template follows the syntax of regexp.Regexp.Expand, e.g. "$1" or "${price}".
+type Expr struct {
+	Pattern  string // Regular expression.
+	Template string // Replacement template.
 }
 
 // Prog is the program global settings which regards all pages unless
@@ -94,21 +179,84 @@ type Prog struct {
 	RecvMail   string        // Mail address to send a notification when a page has been updated.
 	StripFuncs []string      // Strip functions to further specify what to select.
 	FilePerms  os.FileMode   // Permissions to create files with.
-	PortNum    string        // On which port should the nyfikenc/d communication take place.
+	PortNum    string        // On which TCP port should the nyfikenc/d communication take place; empty to use the Unix socket.
+	Socket     string        // Path of the Unix socket for nyfikenc/d communication.
 	Browser    string        // The path to the browser to open updates in.
-
-	// NOTE: I feel uneasy about storing the password in plaintext in the config.
-	// Would it be possible to avoid this somehow, maybe using oauth or
-	// something? As it is only the password of the sending email address, maybe
-	// we could create a "nyfikenbot@gmail.com" or something and use it only for
-	// this purpose.
+	FeedAddr   string        // Address to serve Atom feeds of updates on; empty to disable.
+	HTTPAddr   string        // Address to serve the HTTP API on; empty to disable.
+	WebUI      bool          // Serve the web UI on the HTTP address.
+
+	// Authentication of nyfikenc/d communication; the path to a file with a
+	// token which clients authenticate with, whether TCP communication is
+	// encrypted with TLS, and the pinned SHA-256 fingerprint of the
+	// certificate of nyfikend.
+	TokenFile   string
+	TLS         bool
+	Fingerprint string
+
+	// Duration an external strip command may run before it is killed.
+	ExecTimeout time.Duration
+
+	// Command to run when a page has been updated and the duration it may run
+	// before it is killed.
+	OnUpdate        string
+	OnUpdateTimeout time.Duration
+
+	// Mark updates as read once a notification has been delivered, unless
+	// overwritten by page settings.
+	MarkRead bool
+
+	// Names of the notification targets of pages without targets of their own,
+	// and the targets by name.
+	Notify  []string
+	Targets map[string]Target
+
+	// Suppression of notifications unless overwritten by page settings; the
+	// number of recent snapshots which are considered flapping when seen again,
+	// and the number of notifications per window.
+	FlapLimit  int
+	RateLimit  int
+	RateWindow time.Duration
+
+	// Logging; the minimum level of logged records, their format, the path of
+	// the log file, the size in bytes at which it's rotated and the number of
+	// rotated log files to keep.
+	LogLevel   string
+	LogFormat  string
+	LogFile    string
+	LogMaxSize int64
+	LogBackups int
 
 	// Information about the mail address to send updates.
 	SenderMail struct {
 		Address    string // Mail address of the sending mail.
-		Password   string // Password to that mail address.
+		Password   string // Password to that mail address, resolved from a secret reference if any.
 		AuthServer string // Authorization server to the mail address.
 		OutServer  string // Outgoing server to the mail address.
+		Security   string // Security mode of the connection; tls, starttls or none.
+		Auth       string // Authentication mechanism; plain, login, cram-md5 or none.
+	}
+
+	// Format of notification mails.
+	MailFormat struct {
+		Subject string // Go text/template string of the subject.
+		Text    string // Path to a Go text/template file of the plain text body.
+		HTML    string // Path to a Go html/template file of the HTML body.
+		Attach  bool   // Attach the full snapshot of the page.
+	}
+
+	// Schedules of digest mails; immediate, hourly or daily@HH:MM.
+	Digest struct {
+		Default    string            // Schedule of recipients without a schedule of their own.
+		Recipients map[string]string // Schedules by recipient mail address.
+	}
+
+	// Information about the webhook to post updates to.
+	Webhook struct {
+		URL      string             // URL to POST a notification to when a page has been updated.
+		Template string             // Path to a text/template file of the payload.
+		Payload  *template.Template // Parsed payload template; nil for the default payload.
+		Retries  int                // Number of retries of failed deliveries.
 	}
 }
 
@@ -126,6 +274,15 @@ func initialize() (err error) {
 	ConfigPath = NyfikenRoot + "/config.ini"
 	PagesPath = NyfikenRoot + "/pages.ini"
 	UpdatesPath = NyfikenRoot + "/updates.gob"
+	FeedPath = NyfikenRoot + "/feed.gob"
+	DigestPath = NyfikenRoot + "/digest.gob"
+	HistoryPath = NyfikenRoot + "/history.gob"
+	SocketPath = NyfikenRoot + "/nyfiken.sock"
+	CertPath = NyfikenRoot + "/cert.pem"
+	KeyPath = NyfikenRoot + "/key.pem"
+	LockPath = NyfikenRoot + "/nyfikend.lock"
+	PidPath = NyfikenRoot + "/nyfikend.pid"
+	global = Defaults()
 
 	CacheRoot = NyfikenRoot + "/cache/"
 	ReadRoot = NyfikenRoot + "/read/"
@@ -215,17 +372,76 @@ func initialize() (err error) {
 	return nil
 }
 
-// SaveUpdates saves uncleared updates for next execution.
-func SaveUpdates() (err error) {
-	f, err := os.Create(UpdatesPath)
-	if err != nil {
-		return errutil.Err(err)
+// Defaults returns new program global settings with the default values.
+func Defaults() *Prog {
+	return &Prog{
+		Interval:    DefaultInterval,
+		FilePerms:   DefaultFilePerms,
+		ExecTimeout: DefaultExecTimeout,
+		Socket:      SocketPath,
+
+		OnUpdateTimeout: DefaultOnUpdateTimeout,
+
+		LogMaxSize: DefaultLogMaxSize,
+		LogBackups: DefaultLogBackups,
+	}
+}
+
+// Global returns the program global settings. They are shared and must not be
+// modified; use SetGlobal to replace them.
+func Global() *Prog {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	return global
+}
+
+// SetGlobal replaces the program global settings.
+func SetGlobal(g *Prog) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	global = g
+}
+
+// Updates returns a copy of the uncleared updates.
+func Updates() map[string]bool {
+	updatesMu.RLock()
+	defer updatesMu.RUnlock()
+
+	ups := make(map[string]bool, len(updates))
+	for u, v := range updates {
+		ups[u] = v
 	}
-	defer f.Close()
+	return ups
+}
 
-	enc := gob.NewEncoder(f)
+// AddUpdate marks the page at the URL as updated.
+func AddUpdate(u string) {
+	updatesMu.Lock()
+	updates[u] = true
+	updatesMu.Unlock()
+}
+
+// DelUpdate marks the update of the page at the URL as read.
+func DelUpdate(u string) {
+	updatesMu.Lock()
+	delete(updates, u)
+	updatesMu.Unlock()
+}
+
+// ClearUpdates marks all updates as read.
+func ClearUpdates() {
+	updatesMu.Lock()
+	updates = make(map[string]bool)
+	updatesMu.Unlock()
+}
+
+// SaveUpdates saves uncleared updates for next execution.
+func SaveUpdates() (err error) {
+	// Hold the write lock to serialize concurrent saves to the same file.
+	updatesMu.Lock()
+	defer updatesMu.Unlock()
 
-	err = enc.Encode(&Updates)
+	err = SaveGob(UpdatesPath, &updates)
 	if err != nil {
 		return errutil.Err(err)
 	}
@@ -237,20 +453,17 @@ func SaveUpdates() (err error) {
 
 // LoadUpdates retrieves saved updates from last execution.
 func LoadUpdates() (err error) {
-	f, err := os.Open(UpdatesPath)
+	var ups map[string]bool
+	err = LoadGob(UpdatesPath, &ups)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
 		return errutil.Err(err)
 	}
-	defer f.Close()
-
-	dec := gob.NewDecoder(f)
-
-	err = dec.Decode(&Updates)
-	if err != nil {
-		return errutil.Err(err)
+	if ups == nil {
+		return nil
 	}
+
+	updatesMu.Lock()
+	defer updatesMu.Unlock()
+	updates = ups
 	return nil
 }
@@ -56,13 +56,38 @@ func Attrs(doc *html.Node) {
 	f(doc)
 }
 
-// Scripts removes all script elements from an html.Node.
+// Scripts removes all script and noscript elements from an html.Node.
 func Scripts(doc *html.Node) {
 	var f func(node *html.Node)
 	f = func(node *html.Node) {
-		if node.Type == html.ElementNode && node.Data == "script" {
-			node = nil
-			return
+		// The next sibling is stored before recursing since c may be removed
+		// from the tree.
+		var next *html.Node
+		for c := node.FirstChild; c != nil; c = next {
+			next = c.NextSibling
+			if c.Type == html.ElementNode && (c.Data == "script" || c.Data == "noscript") {
+				node.RemoveChild(c)
+				continue
+			}
+			f(c)
+		}
+	}
+	f(doc)
+}
+
+// Handlers removes all inline event-handler attributes (e.g. onclick) from an
+// html.Node.
+func Handlers(doc *html.Node) {
+	var f func(node *html.Node)
+	f = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			var attrs []html.Attribute
+			for _, attr := range node.Attr {
+				if !strings.HasPrefix(strings.ToLower(attr.Key), "on") {
+					attrs = append(attrs, attr)
+				}
+			}
+			node.Attr = attrs
 		}
 
 		for c := node.FirstChild; c != nil; c = c.NextSibling {
@@ -99,5 +124,5 @@ func HTML(doc *html.Node) {
 
 	// TODO(karlek): Check for errors
 	stringNode, _ := html.Parse(strings.NewReader(newSel))
-	*doc = *stringNode
+	replace(doc, stringNode)
 }
@@ -125,3 +125,62 @@ func TestHTML(t *testing.T) {
 		}
 	}
 }
+
+func TestScripts(t *testing.T) {
+	var golden = []struct {
+		input string
+		want  string
+	}{
+		{`<html><head><script src="ads.js"></script></head><body><b>No scripts</b></body></html>`, `<html><head></head><body><b>No scripts</b></body></html>`},
+		{`<html><head></head><body><script>var ad = 1;</script><b>I stay</b><script>var ad = 2;</script></body></html>`, `<html><head></head><body><b>I stay</b></body></html>`},
+		{`<html><head></head><body><div><noscript>Enable JavaScript</noscript><p>Nested <script>ad();</script>text</p></div></body></html>`, `<html><head></head><body><div><p>Nested text</p></div></body></html>`},
+		{`<html><head></head><body><b>Nothing to remove</b></body></html>`, `<html><head></head><body><b>Nothing to remove</b></body></html>`},
+	}
+
+	for _, g := range golden {
+		doc, err := html.Parse(strings.NewReader(g.input))
+		if err != nil {
+			t.Fatal("error:", err)
+		}
+		Scripts(doc)
+		buf := new(bytes.Buffer)
+		err = html.Render(buf, doc)
+		if err != nil {
+			t.Error("error:", err)
+			continue
+		}
+		got := buf.String()
+		if got != g.want {
+			t.Errorf("output `%v` != expected `%v`", got, g.want)
+		}
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	var golden = []struct {
+		input string
+		want  string
+	}{
+		{`<html><head></head><body><b onclick="track()" class="x">Click</b></body></html>`, `<html><head></head><body><b class="x">Click</b></body></html>`},
+		{`<html><head></head><body onLoad="init()"><img src="a.png" onerror="retry()"/></body></html>`, `<html><head></head><body><img src="a.png"/></body></html>`},
+		{`<html><head></head><body><b style="color: #f00;">No handlers</b></body></html>`, `<html><head></head><body><b style="color: #f00;">No handlers</b></body></html>`},
+	}
+
+	for _, g := range golden {
+		doc, err := html.Parse(strings.NewReader(g.input))
+		if err != nil {
+			t.Fatal("error:", err)
+		}
+		Handlers(doc)
+		buf := new(bytes.Buffer)
+		err = html.Render(buf, doc)
+		if err != nil {
+			t.Error("error:", err)
+			continue
+		}
+		got := buf.String()
+		if got != g.want {
+			t.Errorf("output `%v` != expected `%v`", got, g.want)
+		}
+	}
+}
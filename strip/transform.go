@@ -0,0 +1,139 @@
+package strip
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+	"golang.org/x/net/html"
+)
+
+// ExecPrefix is the prefix of transform names which pipe the document through
+// an external command, e.g. "exec:tidy -q".
+const ExecPrefix = "exec:"
+
+// A Transform modifies an HTML document in place to remove false positives.
+type Transform interface {
+	Transform(doc *html.Node) error
+}
+
+// TransformFunc is an adapter to allow the use of ordinary functions as
+// transforms.
+type TransformFunc func(doc *html.Node) error
+
+// Transform calls f(doc).
+func (f TransformFunc) Transform(doc *html.Node) error {
+	return f(doc)
+}
+
+// simple wraps a strip function which can't fail into a transform.
+func simple(f func(doc *html.Node)) Transform {
+	return TransformFunc(func(doc *html.Node) error {
+		f(doc)
+		return nil
+	})
+}
+
+// Registry of named transforms.
+var (
+	mu         sync.RWMutex
+	transforms = map[string]Transform{
+		"html":     simple(HTML),
+		"attrs":    simple(Attrs),
+		"numbers":  simple(Numbers),
+		"scripts":  simple(Scripts),
+		"handlers": simple(Handlers),
+	}
+)
+
+// Register makes a transform available by the provided name. Names are case
+// insensitive. If Register is called twice with the same name or if the name
+// has the exec prefix, it panics.
+func Register(name string, t Transform) {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, ExecPrefix) {
+		panic("strip: transform name with reserved prefix " + name)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := transforms[name]; dup {
+		panic("strip: Register called twice for transform " + name)
+	}
+	transforms[name] = t
+}
+
+// Lookup returns the transform registered by the provided name. Names with the
+// exec prefix return a transform which runs the specified command.
+func Lookup(name string) (t Transform, err error) {
+	if strings.HasPrefix(strings.ToLower(name), ExecPrefix) {
+		args := strings.Fields(name[len(ExecPrefix):])
+		if len(args) == 0 {
+			return nil, errutil.NewNoPosf("strip: missing command in transform `%s`", name)
+		}
+		return &Exec{Path: args[0], Args: args[1:]}, nil
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	t, found := transforms[strings.ToLower(name)]
+	if !found {
+		return nil, errutil.NewNoPosf("strip: unknown transform `%s`", name)
+	}
+	return t, nil
+}
+
+// Exec is a transform which pipes the rendered document through an external
+// command and parses its standard output as the new document.
+type Exec struct {
+	Path string   // Name or path of the command to run.
+	Args []string // Arguments to the command.
+}
+
+// Transform runs the command with doc as its standard input. The command is
+// killed if it runs longer than the exec timeout of the global settings.
+func (e *Exec) Transform(doc *html.Node) (err error) {
+	in := new(bytes.Buffer)
+	err = html.Render(in, doc)
+	if err != nil {
+		return errutil.Err(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Global().ExecTimeout)
+	defer cancel()
+
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.Path, e.Args...)
+	cmd.Stdin = in
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errutil.NewNoPosf("strip: timeout: %s", e.Path)
+	}
+	if err != nil {
+		return errutil.NewNoPosf("strip: %s: %v: %s", e.Path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	newDoc, err := html.Parse(&out)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	replace(doc, newDoc)
+	return nil
+}
+
+// replace replaces the children of doc with the children of n.
+func replace(doc, n *html.Node) {
+	for c := doc.FirstChild; c != nil; c = doc.FirstChild {
+		doc.RemoveChild(c)
+	}
+	for c := n.FirstChild; c != nil; c = n.FirstChild {
+		n.RemoveChild(c)
+		doc.AppendChild(c)
+	}
+}
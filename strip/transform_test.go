@@ -0,0 +1,103 @@
+package strip
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestLookup(t *testing.T) {
+	var golden = []struct {
+		name  string
+		valid bool
+	}{
+		{"numbers", true},
+		{"Scripts", true},
+		{"exec:cat", true},
+		{"exec:", false},
+		{"nonexistent", false},
+	}
+
+	for _, g := range golden {
+		_, err := Lookup(g.name)
+		if got := err == nil; got != g.valid {
+			t.Errorf("%q: valid %v != expected %v (%v)", g.name, got, g.valid, err)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	var golden = []struct {
+		name string
+		want string
+	}{
+		{"exec:cat", `<html><head></head><body><b>Exec test</b></body></html>`},
+		{"exec:tr a-z A-Z", `<html><head></head><body><b>EXEC TEST</b></body></html>`},
+	}
+
+	for _, g := range golden {
+		doc, err := html.Parse(strings.NewReader(`<html><head></head><body><b>Exec test</b></body></html>`))
+		if err != nil {
+			t.Fatal("error:", err)
+		}
+		tr, err := Lookup(g.name)
+		if err != nil {
+			t.Fatal("error:", err)
+		}
+		err = tr.Transform(doc)
+		if err != nil {
+			t.Error("error:", err)
+			continue
+		}
+		buf := new(bytes.Buffer)
+		err = html.Render(buf, doc)
+		if err != nil {
+			t.Error("error:", err)
+			continue
+		}
+		got := buf.String()
+		if got != g.want {
+			t.Errorf("output `%v` != expected `%v`", got, g.want)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	var golden = []struct {
+		names []string
+		want  string
+	}{
+		// i=0
+		{[]string{"html", "exec:tr a-z A-Z"}, "<html><head></head><body>EXEC TEST 2\n</body></html>"},
+		// i=1
+		{[]string{"html", "exec:cat", "numbers"}, "<html><head></head><body>Exec test \n</body></html>"},
+	}
+
+	for i, g := range golden {
+		doc, err := html.Parse(strings.NewReader(`<html><head></head><body><b>Exec test 2</b></body></html>`))
+		if err != nil {
+			t.Fatal("error:", err)
+		}
+		for _, name := range g.names {
+			tr, err := Lookup(name)
+			if err != nil {
+				t.Fatal("error:", err)
+			}
+			err = tr.Transform(doc)
+			if err != nil {
+				t.Errorf("i=%d: %s: %v", i, name, err)
+			}
+		}
+		buf := new(bytes.Buffer)
+		err = html.Render(buf, doc)
+		if err != nil {
+			t.Error("error:", err)
+			continue
+		}
+		if got := buf.String(); got != g.want {
+			t.Errorf("i=%d: output `%v` != expected `%v`", i, got, g.want)
+		}
+	}
+}
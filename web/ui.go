@@ -0,0 +1,404 @@
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"code.google.com/p/cascadia"
+	"github.com/karlek/nyfiken/cli"
+	"github.com/karlek/nyfiken/feed"
+	"github.com/karlek/nyfiken/page"
+	"github.com/karlek/nyfiken/settings"
+)
+
+// tokenCookie is the name of the cookie which browsers authenticate with.
+const tokenCookie = "nyfiken_token"
+
+// ui are the templates of the web UI. They are compiled into the binary, so
+// the UI has no external assets.
+var ui = template.Must(template.New("ui").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"line": func(l string) string {
+		switch {
+		case strings.HasPrefix(l, "+"):
+			return "add"
+		case strings.HasPrefix(l, "-"):
+			return "del"
+		}
+		return ""
+	},
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>nyfiken{{if .}} - {{.}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; }
+nav a { margin-right: 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: .3em; text-align: left; vertical-align: top; }
+pre { margin: 0; white-space: pre-wrap; word-break: break-all; }
+.add { background: #dfd; }
+.del { background: #fdd; }
+.err { color: #b00; }
+form.inline { display: inline; }
+label { display: block; margin: .5em 0; }
+input[type=text], input[type=password] { width: 30em; }
+</style>
+</head>
+<body>
+<nav><a href="/">Updates</a><a href="/add">Add page</a></nav>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "index"}}{{template "header" ""}}
+<h1>Unread updates</h1>
+{{if .Unread}}<form class="inline" method="post" action="/read"><button>Mark all as read</button></form>
+<table>
+{{range .Unread}}<tr>
+<td><a href="/page?url={{.}}">{{.}}</a></td>
+<td><form class="inline" method="post" action="/read?url={{.}}"><button>Mark as read</button></form></td>
+</tr>
+{{end}}</table>
+{{else}}<p>Sorry, no updates :(</p>
+{{end}}
+<h1>Pages</h1>
+<table>
+<tr><th>Page</th><th>Interval</th><th>Checked</th><th>Updated</th></tr>
+{{range .Pages}}<tr>
+<td><a href="/page?url={{.URL}}">{{.Name}}</a><br>{{.URL}}{{if .Error}}<br><span class="err">{{.Error}}</span>{{end}}</td>
+<td>{{.Interval}}</td>
+<td>{{time .Checked}}</td>
+<td>{{time .Updated}}{{if .Unread}} (unread){{end}}</td>
+</tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+
+{{define "page"}}{{template "header" .Info.Name}}
+<h1>{{.Info.Name}}</h1>
+<p><a href="{{.Info.URL}}">{{.Info.URL}}</a></p>
+<table>
+<tr><th>Interval</th><td>{{.Info.Interval}}</td></tr>
+<tr><th>Tags</th><td>{{range .Info.Tags}}{{.}} {{end}}</td></tr>
+<tr><th>Checked</th><td>{{time .Info.Checked}}</td></tr>
+<tr><th>Updated</th><td>{{time .Info.Updated}}</td></tr>
+{{if .Info.Error}}<tr><th>Error</th><td class="err">{{.Info.Error}}</td></tr>{{end}}
+</table>
+{{if .Info.Unread}}<form method="post" action="/read?url={{.Info.URL}}"><button>Mark as read</button></form>{{end}}
+
+<h2>Diff since last read</h2>
+<p><a href="/page?url={{.Info.URL}}">Inline</a> <a href="/page?url={{.Info.URL}}&amp;view=side">Side by side</a></p>
+{{if .Side}}<table>
+<tr><th>Read</th><th>Cache</th></tr>
+{{range .Side}}<tr><td class="{{if .Old}}del{{end}}"><pre>{{.Old}}</pre></td><td class="{{if .New}}add{{end}}"><pre>{{.New}}</pre></td></tr>
+{{end}}</table>
+{{else if .Lines}}{{range .Lines}}<pre class="{{line .}}">{{.}}</pre>
+{{end}}{{else}}<p>No differences.</p>
+{{end}}
+<h2>History</h2>
+{{range .History}}<h3>{{time .Time}}</h3>
+{{range .Lines}}<pre class="{{line .}}">{{.}}</pre>
+{{end}}{{else}}<p>No recorded updates.</p>
+{{end}}
+{{template "footer"}}{{end}}
+
+{{define "add"}}{{template "header" "Add page"}}
+<h1>Add page</h1>
+{{if .Err}}<p class="err">{{.Err}}</p>{{end}}
+<form method="post" action="/add">
+<label>URL<br><input type="text" name="url" value="{{.URL}}"></label>
+<label>Name<br><input type="text" name="name" value="{{.Name}}"></label>
+<label>CSS selector<br><input type="text" name="sel" value="{{.Sel}}"></label>
+<label>Interval<br><input type="text" name="interval" value="{{.Interval}}" placeholder="{{.DefaultInterval}}"></label>
+<button>Add</button>
+</form>
+{{template "footer"}}{{end}}
+
+{{define "login"}}{{template "header" "Login"}}
+<h1>Login</h1>
+{{if .}}<p class="err">{{.}}</p>{{end}}
+<form method="post" action="/login">
+<label>Token<br><input type="password" name="token"></label>
+<button>Login</button>
+</form>
+{{template "footer"}}{{end}}
+`))
+
+// handleUI adds the handlers of the web UI to mux.
+func handleUI(mux *http.ServeMux) {
+	mux.HandleFunc("/", method("GET", serveIndex))
+	mux.HandleFunc("/page", method("GET", servePage))
+	mux.HandleFunc("/read", method("POST", serveRead))
+	mux.HandleFunc("/add", serveAdd)
+	mux.HandleFunc("/login", serveLogin)
+}
+
+// render executes the named UI template with data.
+func render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := ui.ExecuteTemplate(w, name, data)
+	if err != nil {
+		slog.Error("web UI request failed", "err", err)
+	}
+}
+
+// serveIndex lists the unread updates and the statuses of the pages.
+func serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	var data struct {
+		Unread []string
+		Pages  []PageInfo
+	}
+	for u := range settings.Updates() {
+		data.Unread = append(data.Unread, u)
+	}
+	sort.Strings(data.Unread)
+	data.Pages = pageInfos()
+	render(w, "index", data)
+}
+
+// sideRow is a row of a side by side diff.
+type sideRow struct {
+	Old, New string
+}
+
+// sideBySide pairs the removed and added lines of a diff.
+func sideBySide(d string) (rows []sideRow) {
+	var dels, adds []string
+	flush := func() {
+		for i := 0; i < len(dels) || i < len(adds); i++ {
+			var row sideRow
+			if i < len(dels) {
+				row.Old = dels[i]
+			}
+			if i < len(adds) {
+				row.New = adds[i]
+			}
+			rows = append(rows, row)
+		}
+		dels, adds = nil, nil
+	}
+	for _, l := range lines(d) {
+		switch {
+		case strings.HasPrefix(l, "-"):
+			// A removal after additions starts a new change.
+			if len(adds) > 0 {
+				flush()
+			}
+			dels = append(dels, l[1:])
+		case strings.HasPrefix(l, "+"):
+			adds = append(adds, l[1:])
+		}
+	}
+	flush()
+	return rows
+}
+
+// lines splits a diff into lines.
+func lines(d string) []string {
+	d = strings.TrimSuffix(d, "\n")
+	if d == "" {
+		return nil
+	}
+	return strings.Split(d, "\n")
+}
+
+// servePage shows the status, diff and history of the page of the url
+// parameter.
+func servePage(w http.ResponseWriter, r *http.Request) {
+	p := page.Lookup(r.FormValue("url"))
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	d, _, err := pageDiff(p)
+	if err != nil {
+		slog.Error("web UI request failed", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		Info    PageInfo
+		Lines   []string
+		Side    []sideRow
+		History []struct {
+			Time  time.Time
+			Lines []string
+		}
+	}
+	data.Info = pageInfo(p, settings.Updates())
+	if r.FormValue("view") == "side" {
+		data.Side = sideBySide(d)
+	} else {
+		data.Lines = lines(d)
+	}
+	for _, e := range feed.Entries(p.ReqUrl.String()) {
+		data.History = append(data.History, struct {
+			Time  time.Time
+			Lines []string
+		}{e.Time, lines(e.Content)})
+	}
+	render(w, "page", data)
+}
+
+// serveRead marks the page of the url parameter, or all pages, as read and
+// redirects back.
+func serveRead(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if u := r.FormValue("url"); u != "" {
+		err = page.MarkRead(u)
+	} else {
+		err = page.MarkAllRead()
+	}
+	if err != nil {
+		slog.Error("web UI request failed", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	err = settings.SaveUpdates()
+	if err != nil {
+		slog.Error("web UI request failed", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// Go back to the page the update was marked from.
+	back := "/"
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host {
+		back = ref.RequestURI()
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// addForm is a page to add from the add page form.
+type addForm struct {
+	URL, Name, Sel, Interval string
+	DefaultInterval          string
+	Err                      string
+}
+
+// serveAdd shows the form to add a page, and appends added pages to the pages
+// file, which nyfikend reloads.
+func serveAdd(w http.ResponseWriter, r *http.Request) {
+	form := addForm{DefaultInterval: settings.Global().Interval.String()}
+	switch r.Method {
+	case "GET":
+		render(w, "add", form)
+	case "POST":
+		form.URL = strings.TrimSpace(r.FormValue("url"))
+		form.Name = strings.TrimSpace(r.FormValue("name"))
+		form.Sel = strings.TrimSpace(r.FormValue("sel"))
+		form.Interval = strings.TrimSpace(r.FormValue("interval"))
+		err := addPage(form)
+		if err != nil {
+			form.Err = err.Error()
+			w.WriteHeader(http.StatusBadRequest)
+			render(w, "add", form)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// addPage validates the page of the form and appends it to the pages file.
+// The returned errors are shown to the user.
+func addPage(form addForm) (err error) {
+	for _, v := range []string{form.URL, form.Name, form.Sel, form.Interval} {
+		if strings.ContainsAny(v, "\r\n[]") {
+			return fmt.Errorf("values may not contain newlines or brackets")
+		}
+	}
+	u, err := url.Parse(form.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL %q; it must be an http or https URL", form.URL)
+	}
+	if page.Lookup(u.String()) != nil {
+		return fmt.Errorf("page %q is already checked", u)
+	}
+	if form.Sel != "" {
+		if _, err := cascadia.Compile(form.Sel); err != nil {
+			return fmt.Errorf("invalid CSS selector %q", form.Sel)
+		}
+	}
+	if form.Interval != "" {
+		if _, err := time.ParseDuration(form.Interval); err != nil {
+			return fmt.Errorf("invalid interval %q; e.g. 10m", form.Interval)
+		}
+	}
+
+	section := fmt.Sprintf("\n[%s]\n", u)
+	if form.Name != "" {
+		section += fmt.Sprintf("name = %s\n", form.Name)
+	}
+	if form.Sel != "" {
+		section += fmt.Sprintf("sel = %s\n", form.Sel)
+	}
+	if form.Interval != "" {
+		section += fmt.Sprintf("interval = %s\n", form.Interval)
+	}
+	f, err := os.OpenFile(settings.PagesPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, settings.Global().FilePerms)
+	if err != nil {
+		slog.Error("web UI request failed", "err", err)
+		return fmt.Errorf("unable to open the pages file")
+	}
+	defer f.Close()
+	_, err = io.WriteString(f, section)
+	if err != nil {
+		slog.Error("web UI request failed", "err", err)
+		return fmt.Errorf("unable to write to the pages file")
+	}
+	return nil
+}
+
+// serveLogin lets browsers authenticate with the token, which is stored in a
+// cookie.
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		render(w, "login", "")
+		return
+	}
+	token, err := cli.ReadToken()
+	if err != nil {
+		slog.Error("web UI request failed", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	given := r.FormValue("token")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		render(w, "login", "Invalid token.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Value:    given,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
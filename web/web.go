@@ -0,0 +1,400 @@
+// Package web serves an HTTP API of nyfikend, which lists pages and updates,
+// clears updates, rechecks pages and shows their diffs and histories as JSON.
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karlek/nyfiken/cli"
+	"github.com/karlek/nyfiken/diff"
+	"github.com/karlek/nyfiken/feed"
+	"github.com/karlek/nyfiken/filename"
+	"github.com/karlek/nyfiken/logging"
+	"github.com/karlek/nyfiken/metrics"
+	"github.com/karlek/nyfiken/page"
+	"github.com/karlek/nyfiken/settings"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Listen makes nyfikend serve the HTTP API on the HTTP address.
+func Listen() {
+	srv := &http.Server{Addr: settings.Global().HTTPAddr, Handler: Handler()}
+	serverMu.Lock()
+	server = srv
+	serverMu.Unlock()
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		logging.Fatal("unable to serve the HTTP API", "err", err)
+	}
+}
+
+// server is the server of Listen, which Shutdown shuts down.
+var (
+	serverMu sync.Mutex
+	server   *http.Server
+)
+
+// Shutdown stops serving the HTTP API, and waits for active requests until the
+// context is done.
+func Shutdown(ctx context.Context) (err error) {
+	serverMu.Lock()
+	srv := server
+	serverMu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	return nil
+}
+
+// Handler returns an HTTP handler which serves the API:
+//
+//	GET    /api/pages              List pages and their statuses.
+//	GET    /api/updates            List updated pages.
+//	DELETE /api/updates[?url=URL]  Clear all updates, or the update of a page.
+//	POST   /api/recheck[?url=URL]  Recheck all pages, or a page.
+//	GET    /api/diff?url=URL       Diff of a page since it was last read.
+//	GET    /api/history?url=URL    Recent updates of a page.
+//	GET    /metrics                Metrics in the Prometheus text format.
+//
+// The web UI is served at "/" if enabled.
+//
+// Requests must address nyfikend by an IP address, localhost or the host of the
+// HTTP address, and requests from other sites may only read. Clients
+// authenticate with the token of the token file as a bearer token, if one is
+// set. Browsers of the web UI log in at "/login" instead, which stores
+// the token in a cookie.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/pages", method("GET", servePages))
+	mux.HandleFunc("/api/updates", serveUpdates)
+	mux.HandleFunc("/api/recheck", method("POST", serveRecheck))
+	mux.HandleFunc("/api/diff", method("GET", serveDiff))
+	mux.HandleFunc("/api/history", method("GET", serveHistory))
+	mux.Handle("/metrics", metrics.Handler())
+	if settings.Global().WebUI {
+		handleUI(mux)
+	}
+	return guard(authorize(mux))
+}
+
+// guard refuses requests to h which address nyfikend by an unknown host name,
+// so other sites can't reach it by rebinding their DNS names to the local
+// host. It also refuses requests from other sites which modify the state of
+// nyfikend, such as forms or scripts posting to the API with the browser of
+// the user.
+func guard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api := strings.HasPrefix(r.URL.Path, "/api/")
+		if !knownHost(r.Host) {
+			if api {
+				writeError(w, http.StatusMisdirectedRequest, "web: unknown host %s", r.Host)
+			} else {
+				http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+			}
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			if crossSite(r) {
+				if api {
+					writeError(w, http.StatusForbidden, "web: cross-site request refused")
+				} else {
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				}
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// knownHost reports whether host addresses nyfikend; an IP address, localhost
+// or the host of the HTTP address.
+func knownHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if net.ParseIP(host) != nil || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	addrHost, _, err := net.SplitHostPort(settings.Global().HTTPAddr)
+	return err == nil && addrHost != "" && strings.EqualFold(host, addrHost)
+}
+
+// crossSite reports whether the request was made by another site, according
+// to the Sec-Fetch-Site or Origin headers sent by browsers.
+func crossSite(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err != nil || u.Host != r.Host
+	}
+	return false
+}
+
+// authorize requires clients of h to authenticate with the token, if one is
+// set.
+func authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := cli.ReadToken()
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if token == "" || r.URL.Path == "/login" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if c, err := r.Cookie(tokenCookie); given == "" && err == nil {
+			given = c.Value
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/api/") && settings.Global().WebUI {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="nyfiken"`)
+		writeError(w, http.StatusUnauthorized, "web: invalid token")
+	})
+}
+
+// method only lets requests with the HTTP method through to f.
+func method(m string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			w.Header().Set("Allow", m)
+			writeError(w, http.StatusMethodNotAllowed, "web: method %s not allowed", r.Method)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// PageInfo describes a checked page.
+type PageInfo struct {
+	URL      string    `json:"url"`
+	Name     string    `json:"name"`
+	Interval string    `json:"interval"`
+	Tags     []string  `json:"tags"`
+	Unread   bool      `json:"unread"`          // The page has an update which hasn't been read.
+	Checked  time.Time `json:"checked"`         // Time of the last check.
+	Updated  time.Time `json:"updated"`         // Time of the last detected update.
+	Error    string    `json:"error,omitempty"` // Error of the last check.
+}
+
+// servePages lists the checked pages and their statuses.
+func servePages(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, pageInfos())
+}
+
+// pageInfos describes the checked pages.
+func pageInfos() (infos []PageInfo) {
+	ups := settings.Updates()
+	infos = []PageInfo{}
+	for _, p := range page.Pages() {
+		infos = append(infos, pageInfo(p, ups))
+	}
+	return infos
+}
+
+// pageInfo describes the page, given the updated pages.
+func pageInfo(p *page.Page, ups map[string]bool) PageInfo {
+	u := p.ReqUrl.String()
+	s := page.StatusOf(u)
+	return PageInfo{
+		URL:      u,
+		Name:     p.Name(),
+		Interval: p.Settings.Interval.String(),
+		Tags:     p.Settings.Tags,
+		Unread:   ups[u],
+		Checked:  s.Checked,
+		Updated:  s.Updated,
+		Error:    s.Err,
+	}
+}
+
+// serveUpdates lists or clears the updated pages.
+func serveUpdates(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		urls := []string{}
+		for u := range settings.Updates() {
+			urls = append(urls, u)
+		}
+		sort.Strings(urls)
+		writeJSON(w, http.StatusOK, urls)
+	case "DELETE":
+		// Mark the updates as read, like nyfikenc does when it clears them.
+		var err error
+		if u := r.FormValue("url"); u != "" {
+			err = page.MarkRead(u)
+		} else {
+			err = page.MarkAllRead()
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		err = settings.SaveUpdates()
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "web: method %s not allowed", r.Method)
+	}
+}
+
+// serveRecheck rechecks all pages, or the page of the url parameter. The
+// checks run in the background.
+func serveRecheck(w http.ResponseWriter, r *http.Request) {
+	ps := page.Pages()
+	if u := r.FormValue("url"); u != "" {
+		p := page.Lookup(u)
+		if p == nil {
+			writeError(w, http.StatusNotFound, "web: unknown page `%s`", u)
+			return
+		}
+		ps = []*page.Page{p}
+	}
+	err := page.ForceUpdate(ps)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Diff is the difference of a page since it was last read.
+type Diff struct {
+	URL  string `json:"url"`
+	Diff string `json:"diff"`
+}
+
+// serveDiff writes the differing lines between the last read and the last
+// checked selection of the page of the url parameter.
+func serveDiff(w http.ResponseWriter, r *http.Request) {
+	p, ok := lookup(w, r)
+	if !ok {
+		return
+	}
+	d, checked, err := pageDiff(p)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if !checked {
+		writeError(w, http.StatusNotFound, "web: page `%s` hasn't been checked yet", p.ReqUrl)
+		return
+	}
+	writeJSON(w, http.StatusOK, Diff{URL: p.ReqUrl.String(), Diff: d})
+}
+
+// pageDiff returns the differing lines between the last read and the last
+// checked selection of the page, and whether the page has been checked.
+func pageDiff(p *page.Page) (d string, checked bool, err error) {
+	fname, err := filename.Encode(p.UrlAsFilename())
+	if err != nil {
+		return "", false, errutil.Err(err)
+	}
+	cur, err := ioutil.ReadFile(settings.CacheRoot + fname + ".htm")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, errutil.Err(err)
+	}
+	read, err := ioutil.ReadFile(settings.ReadRoot + fname + ".htm")
+	if err != nil && !os.IsNotExist(err) {
+		return "", false, errutil.Err(err)
+	}
+	return diff.Lines(string(read), string(cur)), true, nil
+}
+
+// Update is a recent update of a page.
+type Update struct {
+	Time    time.Time `json:"time"`    // Time of detection.
+	Content string    `json:"content"` // Differing lines, or the new content if unavailable.
+}
+
+// serveHistory writes the recent updates of the page of the url parameter,
+// newest first.
+func serveHistory(w http.ResponseWriter, r *http.Request) {
+	p, ok := lookup(w, r)
+	if !ok {
+		return
+	}
+	ups := []Update{}
+	for _, e := range feed.Entries(p.ReqUrl.String()) {
+		ups = append(ups, Update{Time: e.Time, Content: e.Content})
+	}
+	writeJSON(w, http.StatusOK, ups)
+}
+
+// lookup returns the page of the url parameter, or writes an error if there is
+// none.
+func lookup(w http.ResponseWriter, r *http.Request) (p *page.Page, ok bool) {
+	u := r.FormValue("url")
+	if u == "" {
+		writeError(w, http.StatusBadRequest, "web: missing url parameter")
+		return nil, false
+	}
+	p = page.Lookup(u)
+	if p == nil {
+		writeError(w, http.StatusNotFound, "web: unknown page `%s`", u)
+		return nil, false
+	}
+	return p, true
+}
+
+// writeJSON writes v as JSON with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Error("unable to write response", "err", err)
+	}
+}
+
+// writeError writes the formatted error message as JSON with the status code.
+func writeError(w http.ResponseWriter, code int, format string, a ...interface{}) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{fmt.Sprintf(format, a...)})
+}
+
+// internalError logs the error and writes a generic error message.
+func internalError(w http.ResponseWriter, err error) {
+	slog.Error("web request failed", "err", err)
+	writeError(w, http.StatusInternalServerError, "web: internal error")
+}
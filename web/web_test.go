@@ -0,0 +1,309 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karlek/nyfiken/feed"
+	"github.com/karlek/nyfiken/filename"
+	"github.com/karlek/nyfiken/page"
+	"github.com/karlek/nyfiken/settings"
+)
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-web")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.UpdatesPath = filepath.Join(dir, "updates.gob")
+	settings.FeedPath = filepath.Join(dir, "feed.gob")
+	settings.CacheRoot = dir + "/cache/"
+	settings.ReadRoot = dir + "/read/"
+	settings.DebugCacheRoot = dir + "/debug/cache/"
+	settings.DebugReadRoot = dir + "/debug/read/"
+	defer settings.SetGlobal(settings.Global())
+	g := *settings.Global()
+	g.TokenFile = filepath.Join(dir, "token")
+	g.HTTPAddr = "example.com:80"
+	g.FilePerms = 0600
+	settings.SetGlobal(&g)
+
+	// A checked page, which has been updated since it was read.
+	u, _ := url.Parse("http://example.org/a")
+	p := &page.Page{ReqUrl: u, Settings: settings.Page{Interval: time.Minute, Tags: []string{"news"}}}
+	page.SetPages([]*page.Page{p})
+	fname, err := filename.Encode(p.UrlAsFilename())
+	if err != nil {
+		t.Fatal("filename.Encode:", err)
+	}
+	files := map[string]string{
+		g.TokenFile:                         "secret\n",
+		settings.CacheRoot + fname + ".htm": "old\nnew",
+		settings.ReadRoot + fname + ".htm":  "old",
+	}
+	for path, content := range files {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err = ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal("ioutil.WriteFile:", err)
+		}
+	}
+	settings.ClearUpdates()
+	settings.AddUpdate(u.String())
+	settings.AddUpdate("http://example.org/b")
+	err = feed.Add(feed.Entry{URL: u.String(), Name: "a", Time: time.Unix(1, 0), Content: "+new"})
+	if err != nil {
+		t.Fatal("feed.Add:", err)
+	}
+
+	golden := []struct {
+		method, path string
+		token        string
+		host         string
+		header       map[string]string
+		wantCode     int
+		wantBody     string
+	}{
+		// i=0
+		{method: "GET", path: "/api/pages", wantCode: 401, wantBody: `{"error":"web: invalid token"}`},
+		// i=1
+		{method: "GET", path: "/api/pages", token: "wrong", wantCode: 401},
+		// i=2
+		{method: "GET", path: "/api/pages", token: "secret", wantCode: 200, wantBody: `[{"url":"http://example.org/a","name":"example.org","interval":"1m0s","tags":["news"],"unread":true,"checked":"0001-01-01T00:00:00Z","updated":"0001-01-01T00:00:00Z"}]`},
+		// i=3
+		{method: "GET", path: "/api/updates", token: "secret", wantCode: 200, wantBody: `["http://example.org/a","http://example.org/b"]`},
+		// i=4
+		{method: "GET", path: "/api/diff?url=http://example.org/a", token: "secret", wantCode: 200, wantBody: `{"url":"http://example.org/a","diff":"+new\n"}`},
+		// i=5
+		{method: "GET", path: "/api/diff?url=http://example.org/b", token: "secret", wantCode: 404},
+		// i=6
+		{method: "GET", path: "/api/diff", token: "secret", wantCode: 400},
+		// i=7
+		{method: "GET", path: "/api/history?url=http://example.org/a", token: "secret", wantCode: 200, wantBody: `[{"time":"` + time.Unix(1, 0).Format(time.RFC3339Nano) + `","content":"+new"}]`},
+		// i=8
+		{method: "GET", path: "/api/recheck", token: "secret", wantCode: 405},
+		// i=9
+		{method: "POST", path: "/api/recheck?url=http://example.org/c", token: "secret", wantCode: 404},
+		// i=10
+		{method: "DELETE", path: "/api/updates?url=http://example.org/b", token: "secret", wantCode: 204},
+		// i=11
+		{method: "GET", path: "/api/updates", token: "secret", wantCode: 200, wantBody: `["http://example.org/a"]`},
+		// i=12
+		{method: "DELETE", path: "/api/updates", token: "secret", wantCode: 204},
+		// i=13
+		{method: "GET", path: "/api/updates", token: "secret", wantCode: 200, wantBody: `[]`},
+		// Cleared updates are diffed against the snapshot they were read at.
+		// i=14
+		{method: "GET", path: "/api/diff?url=http://example.org/a", token: "secret", wantCode: 200, wantBody: `{"url":"http://example.org/a","diff":""}`},
+		// Requests from other sites may only read, even without a token.
+		// i=15
+		{method: "POST", path: "/api/recheck", header: map[string]string{"Origin": "http://evil.example.net"}, wantCode: 403},
+		// i=16
+		{method: "DELETE", path: "/api/updates", token: "secret", header: map[string]string{"Sec-Fetch-Site": "cross-site"}, wantCode: 403},
+		// i=17
+		{method: "GET", path: "/api/updates", token: "secret", header: map[string]string{"Sec-Fetch-Site": "cross-site"}, wantCode: 200},
+		// Host names rebound to the local host are refused.
+		// i=18
+		{method: "GET", path: "/api/updates", token: "secret", host: "evil.example.net:80", wantCode: 421},
+		// i=19
+		{method: "GET", path: "/api/updates", token: "secret", host: "127.0.0.1:5241", wantCode: 200},
+		// i=20
+		{method: "GET", path: "/api/updates", token: "secret", host: "localhost:5241", wantCode: 200},
+	}
+
+	h := Handler()
+	for i, g := range golden {
+		r := httptest.NewRequest(g.method, g.path, nil)
+		if g.token != "" {
+			r.Header.Set("Authorization", "Bearer "+g.token)
+		}
+		if g.host != "" {
+			r.Host = g.host
+		}
+		for k, v := range g.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != g.wantCode {
+			t.Errorf("i=%d: status code: expected %d, got %d", i, g.wantCode, w.Code)
+		}
+		if got := strings.TrimSpace(w.Body.String()); g.wantBody != "" && got != g.wantBody {
+			t.Errorf("i=%d: body: expected %s, got %s", i, g.wantBody, got)
+		}
+	}
+}
+
+func TestSideBySide(t *testing.T) {
+	golden := []struct {
+		diff string
+		want []sideRow
+	}{
+		// i=0
+		{diff: "", want: nil},
+		// i=1
+		{diff: "-a\n+b\n", want: []sideRow{{Old: "a", New: "b"}}},
+		// i=2
+		{diff: "-a\n-b\n+c\n", want: []sideRow{{Old: "a", New: "c"}, {Old: "b"}}},
+		// i=3
+		{diff: "+a\n-b\n+c\n+d\n", want: []sideRow{{New: "a"}, {Old: "b", New: "c"}, {New: "d"}}},
+	}
+
+	for i, g := range golden {
+		got := sideBySide(g.diff)
+		if len(got) != len(g.want) {
+			t.Errorf("i=%d: expected %v, got %v", i, g.want, got)
+			continue
+		}
+		for j := range got {
+			if got[j] != g.want[j] {
+				t.Errorf("i=%d: expected %v, got %v", i, g.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestUI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyfiken-web")
+	if err != nil {
+		t.Fatal("ioutil.TempDir:", err)
+	}
+	defer os.RemoveAll(dir)
+	settings.UpdatesPath = filepath.Join(dir, "updates.gob")
+	settings.PagesPath = filepath.Join(dir, "pages.ini")
+	settings.CacheRoot = dir + "/cache/"
+	settings.ReadRoot = dir + "/read/"
+	settings.DebugCacheRoot = dir + "/debug/cache/"
+	settings.DebugReadRoot = dir + "/debug/read/"
+	defer settings.SetGlobal(settings.Global())
+	g := *settings.Global()
+	g.TokenFile = filepath.Join(dir, "token")
+	g.WebUI = true
+	g.HTTPAddr = "example.com:80"
+	g.FilePerms = 0600
+	settings.SetGlobal(&g)
+
+	u, _ := url.Parse("http://example.org/a")
+	p := &page.Page{ReqUrl: u}
+	page.SetPages([]*page.Page{p})
+	fname, err := filename.Encode(p.UrlAsFilename())
+	if err != nil {
+		t.Fatal("filename.Encode:", err)
+	}
+	files := map[string]string{
+		g.TokenFile:                              "secret",
+		settings.CacheRoot + fname + ".htm":      "old\nnew",
+		settings.ReadRoot + fname + ".htm":       "old",
+		settings.DebugCacheRoot + fname + ".htm": "<p>new</p>",
+		settings.DebugReadRoot + fname + ".htm":  "<p>old</p>",
+	}
+	for path, content := range files {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err = ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal("ioutil.WriteFile:", err)
+		}
+	}
+	settings.ClearUpdates()
+	settings.AddUpdate(u.String())
+
+	golden := []struct {
+		method, path string
+		body         *strings.Reader
+		cookie       string
+		origin       string
+		wantCode     int
+		wantBody     string
+	}{
+		// Browsers without the token cookie are sent to the login page.
+		// i=0
+		{method: "GET", path: "/", wantCode: 303},
+		// i=1
+		{method: "GET", path: "/login", wantCode: 200, wantBody: `name="token"`},
+		// i=2
+		{method: "POST", path: "/login", body: strings.NewReader("token=wrong"), wantCode: 401, wantBody: "Invalid token."},
+		// i=3
+		{method: "POST", path: "/login", body: strings.NewReader("token=secret"), wantCode: 303},
+		// i=4
+		{method: "GET", path: "/", cookie: "secret", wantCode: 200, wantBody: `action="/read?url=http%3a%2f%2fexample.org%2fa"`},
+		// i=5
+		{method: "GET", path: "/page?url=http://example.org/a", cookie: "secret", wantCode: 200, wantBody: `<pre class="add">&#43;new</pre>`},
+		// i=6
+		{method: "GET", path: "/page?url=http://example.org/a&view=side", cookie: "secret", wantCode: 200, wantBody: `<td class="add"><pre>new</pre></td>`},
+		// i=7
+		{method: "GET", path: "/page?url=http://example.org/b", cookie: "secret", wantCode: 404},
+		// Forms posted from other sites are refused.
+		// i=8
+		{method: "POST", path: "/read", cookie: "secret", origin: "http://evil.example.com", wantCode: 403},
+		// i=9
+		{method: "POST", path: "/read?url=http://example.org/a", cookie: "secret", origin: "http://example.com", wantCode: 303},
+		// i=10
+		{method: "GET", path: "/page?url=http://example.org/a", cookie: "secret", wantCode: 200, wantBody: "No differences."},
+		// i=11
+		{method: "POST", path: "/add", body: strings.NewReader("url=ftp://example.org/"), cookie: "secret", wantCode: 400, wantBody: "invalid URL"},
+		// i=12
+		{method: "POST", path: "/add", body: strings.NewReader("url=http://example.org/a"), cookie: "secret", wantCode: 400, wantBody: "already checked"},
+		// i=13
+		{method: "POST", path: "/add", body: strings.NewReader("url=http://example.org/c&name=c%0A[x]"), cookie: "secret", wantCode: 400, wantBody: "newlines"},
+		// i=14
+		{method: "POST", path: "/add", body: strings.NewReader("url=http://example.org/c&interval=soon"), cookie: "secret", wantCode: 400, wantBody: "invalid interval"},
+		// i=15
+		{method: "POST", path: "/add", body: strings.NewReader("url=http://example.org/c&name=c&sel=div.news&interval=1h"), cookie: "secret", wantCode: 303},
+	}
+
+	h := Handler()
+	for i, g := range golden {
+		var r *http.Request
+		if g.body != nil {
+			r = httptest.NewRequest(g.method, g.path, g.body)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(g.method, g.path, nil)
+		}
+		if g.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: tokenCookie, Value: g.cookie})
+		}
+		if g.origin != "" {
+			r.Header.Set("Origin", g.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != g.wantCode {
+			t.Errorf("i=%d: status code: expected %d, got %d", i, g.wantCode, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), g.wantBody) {
+			t.Errorf("i=%d: expected body containing %q, got %q", i, g.wantBody, w.Body.String())
+		}
+	}
+
+	// The read snapshots are replaced by the cached ones.
+	buf, err := ioutil.ReadFile(settings.DebugReadRoot + fname + ".htm")
+	if err != nil {
+		t.Fatal("ioutil.ReadFile:", err)
+	}
+	if string(buf) != "<p>new</p>" {
+		t.Errorf("expected read debug snapshot %q, got %q", "<p>new</p>", buf)
+	}
+	if settings.Updates()[u.String()] {
+		t.Errorf("expected %s to be marked as read", u)
+	}
+
+	// The added page is appended to the pages file.
+	buf, err = ioutil.ReadFile(settings.PagesPath)
+	if err != nil {
+		t.Fatal("ioutil.ReadFile:", err)
+	}
+	want := "\n[http://example.org/c]\nname = c\nsel = div.news\ninterval = 1h\n"
+	if string(buf) != want {
+		t.Errorf("expected pages file %q, got %q", want, buf)
+	}
+}